@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// sourceImagesAnnotation holds JSON mapping backup image -> upstream image,
+	// for containers of the workload rewritten to use backup images
+	sourceImagesAnnotation = "imgclonectrl.io/source-images"
+)
+
+// sourceImages returns mapping backup image -> upstream image of images the object
+// was rewritten to use
+func sourceImages(obj client.Object) (map[string]string, error) {
+	images := map[string]string{}
+	value, exists := obj.GetAnnotations()[sourceImagesAnnotation]
+	if !exists {
+		return images, nil
+	}
+	if err := json.Unmarshal([]byte(value), &images); err != nil {
+		return map[string]string{}, fmt.Errorf("could not parse annotation %s: %w", sourceImagesAnnotation, err)
+	}
+	return images, nil
+}
+
+// setSourceImages stores mapping backup image -> upstream image in object annotation.
+// Empty mapping removes the annotation
+func setSourceImages(obj client.Object, images map[string]string) {
+	annotations := obj.GetAnnotations()
+	if len(images) == 0 {
+		delete(annotations, sourceImagesAnnotation)
+		obj.SetAnnotations(annotations)
+		return
+	}
+
+	value, _ := json.Marshal(images)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[sourceImagesAnnotation] = string(value)
+	obj.SetAnnotations(annotations)
+}
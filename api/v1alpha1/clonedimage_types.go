@@ -0,0 +1,55 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClonedImageSpec identifies backup of the source image
+type ClonedImageSpec struct {
+	// Source is upstream image reference
+	Source string `json:"source"`
+	// Target is backup image reference
+	Target string `json:"target"`
+}
+
+// ClonedImageStatus describes backup of the source image
+type ClonedImageStatus struct {
+	// Digest of the backup image
+	Digest string `json:"digest,omitempty"`
+	// Size is compressed size of the backup image (config and layers)
+	Size int64 `json:"size,omitempty"`
+	// Platforms of the backup image, as os/architecture
+	Platforms []string `json:"platforms,omitempty"`
+	// BackedUpAt is the last time backup was made (or found up to date)
+	BackedUpAt *metav1.Time `json:"backedUpAt,omitempty"`
+	// LastVerifiedAt is the last time backup was verified to be present in backup registry
+	LastVerifiedAt *metav1.Time `json:"lastVerifiedAt,omitempty"`
+	// UpstreamState is the state of upstream image: Available, Deleted or Moved
+	UpstreamState string `json:"upstreamState,omitempty"`
+	// UpstreamDigest is the digest of upstream image, as seen by the last check
+	UpstreamDigest string `json:"upstreamDigest,omitempty"`
+	// UpstreamSince is the time upstream image came to UpstreamState
+	UpstreamSince *metav1.Time `json:"upstreamSince,omitempty"`
+	// Workloads using the backup image, as Kind/namespace/name
+	Workloads []string `json:"workloads,omitempty"`
+}
+
+// ClonedImage is a record of the source image backed up by the controller
+type ClonedImage struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClonedImageSpec   `json:"spec,omitempty"`
+	Status ClonedImageStatus `json:"status,omitempty"`
+}
+
+// ClonedImageList contains a list of ClonedImage
+type ClonedImageList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClonedImage `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClonedImage{}, &ClonedImageList{})
+}
@@ -0,0 +1,79 @@
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto copies the receiver into out
+func (in *ClonedImageStatus) DeepCopyInto(out *ClonedImageStatus) {
+	*out = *in
+	if in.Platforms != nil {
+		out.Platforms = make([]string, len(in.Platforms))
+		copy(out.Platforms, in.Platforms)
+	}
+	if in.BackedUpAt != nil {
+		out.BackedUpAt = in.BackedUpAt.DeepCopy()
+	}
+	if in.LastVerifiedAt != nil {
+		out.LastVerifiedAt = in.LastVerifiedAt.DeepCopy()
+	}
+	if in.UpstreamSince != nil {
+		out.UpstreamSince = in.UpstreamSince.DeepCopy()
+	}
+	if in.Workloads != nil {
+		out.Workloads = make([]string, len(in.Workloads))
+		copy(out.Workloads, in.Workloads)
+	}
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *ClonedImage) DeepCopyInto(out *ClonedImage) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy creates a new ClonedImage, copying the receiver
+func (in *ClonedImage) DeepCopy() *ClonedImage {
+	if in == nil {
+		return nil
+	}
+	out := new(ClonedImage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object
+func (in *ClonedImage) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *ClonedImageList) DeepCopyInto(out *ClonedImageList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]ClonedImage, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy creates a new ClonedImageList, copying the receiver
+func (in *ClonedImageList) DeepCopy() *ClonedImageList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClonedImageList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object
+func (in *ClonedImageList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// errorClass is a class of image copy failure, that determines retry policy
+type errorClass int
+
+const (
+	classTransient        errorClass = iota //network errors, 5xx etc. Retried with backoff
+	classRateLimited                        //429, retried after Retry-After (or backoff)
+	classNotFound                           //image or repository does not exist. Permanent
+	classUnauthorized                       //401 or 403 from registry. Permanent
+	classInvalidReference                   //image reference can not be parsed. Permanent
+)
+
+// String returns class name, used as event reason
+func (c errorClass) String() string {
+	switch c {
+	case classRateLimited:
+		return "RateLimited"
+	case classNotFound:
+		return "ImageNotFound"
+	case classUnauthorized:
+		return "RegistryUnauthorized"
+	case classInvalidReference:
+		return "InvalidImageReference"
+	default:
+		return "TransientError"
+	}
+}
+
+// permanent reports whether retrying makes no sense until workload spec changes
+func (c errorClass) permanent() bool {
+	return c == classNotFound || c == classUnauthorized || c == classInvalidReference
+}
+
+// copyError is image copy failure along with its class
+type copyError struct {
+	class      errorClass
+	retryAfter time.Duration //as requested by registry, if any
+	err        error
+}
+
+func (e *copyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *copyError) Unwrap() error {
+	return e.err
+}
+
+// copyErrors is a set of failures of images copied within single reconcile
+type copyErrors []*copyError
+
+func (e copyErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// class returns the class determining retry of the whole reconcile:
+// it's permanent only if every image failed permanently, otherwise
+// the most restrictive retryable class is returned
+func (e copyErrors) class() (errorClass, time.Duration) {
+	var (
+		class      = classNotFound
+		retryAfter time.Duration
+		retryable  bool
+	)
+	for _, err := range e {
+		switch {
+		case err.class == classRateLimited:
+			class, retryable = classRateLimited, true
+			if err.retryAfter > retryAfter {
+				retryAfter = err.retryAfter
+			}
+		case !err.class.permanent() && class != classRateLimited:
+			class, retryable = classTransient, true
+		case err.class != classNotFound && !retryable:
+			class = err.class
+		}
+	}
+	return class, retryAfter
+}
+
+// failureClass returns class and Retry-After of reconcile failure. Failures
+// other than (possibly wrapped) copyErrors are transient
+func failureClass(err error) (errorClass, time.Duration) {
+	var cerrs copyErrors
+	if errors.As(err, &cerrs) {
+		return cerrs.class()
+	}
+	return classTransient, 0
+}
+
+// classifyError determines class of registry error
+func classifyError(err error) errorClass {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return classTransient
+	}
+
+	for _, d := range terr.Errors {
+		switch d.Code {
+		case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode:
+			return classNotFound
+		case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+			return classUnauthorized
+		case transport.TooManyRequestsErrorCode:
+			return classRateLimited
+		}
+	}
+
+	switch terr.StatusCode {
+	case http.StatusNotFound:
+		return classNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return classUnauthorized
+	case http.StatusTooManyRequests:
+		return classRateLimited
+	}
+	return classTransient
+}
+
+// isUpstreamGone reports whether anonymous request of the upstream image failed, since the image is
+// definitely gone: registry responded "not found", or Docker Hub responded 401 UNAUTHORIZED, which it
+// returns to anonymous pulls of deleted and nonexistent repositories instead of 404
+func isUpstreamGone(ref name.Reference, err error) bool {
+	if classifyError(err) == classNotFound {
+		return true
+	}
+	if ref.Context().RegistryStr() != name.DefaultRegistry {
+		return false
+	}
+
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusUnauthorized {
+		return true
+	}
+	for _, d := range terr.Errors {
+		if d.Code == transport.UnauthorizedErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfterTransport remembers Retry-After of 429 responses, since it is not
+// exposed by transport.Error
+type retryAfterTransport struct {
+	inner http.RoundTripper
+
+	mu         sync.Mutex
+	retryAfter time.Duration
+}
+
+// newRetryAfterTransport wraps default http transport (the one go-containerregistry uses)
+func newRetryAfterTransport() *retryAfterTransport {
+	return &retryAfterTransport{inner: http.DefaultTransport}
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		if d := parseRetryAfter(resp.Header.Get("Retry-After")); d > 0 {
+			t.mu.Lock()
+			t.retryAfter = d
+			t.mu.Unlock()
+		}
+	}
+	return resp, err
+}
+
+// last returns the latest Retry-After received
+func (t *retryAfterTransport) last() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.retryAfter
+}
+
+// parseRetryAfter parses Retry-After header, given either in seconds or as http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// backoffPolicy is exponential backoff: base * 2^(failures-1), capped by max
+type backoffPolicy struct {
+	base, max time.Duration
+}
+
+func (p backoffPolicy) delay(failures int) time.Duration {
+	if failures < 1 {
+		failures = 1
+	}
+	d := float64(p.base) * math.Pow(2, float64(failures-1))
+	if d > float64(p.max) {
+		return p.max
+	}
+	return time.Duration(d)
+}
+
+var (
+	//Per class backoff policies. Permanent failures are not retried at all
+	transientBackoff   = backoffPolicy{base: 3 * time.Second, max: 5 * time.Minute}
+	rateLimitedBackoff = backoffPolicy{base: time.Minute, max: time.Hour}
+)
+
+// backoffTracker counts consecutive failures of workloads.
+// Nil tracker does not count, i.e. always returns the first delay
+type backoffTracker struct {
+	mu       sync.Mutex
+	failures map[workloadRef]int
+}
+
+func newBackoffTracker() *backoffTracker {
+	return &backoffTracker{failures: map[workloadRef]int{}}
+}
+
+// next registers failure of the class and returns delay before the next attempt
+func (b *backoffTracker) next(key workloadRef, class errorClass, retryAfter time.Duration) time.Duration {
+	failures := 1
+	if b != nil {
+		b.mu.Lock()
+		b.failures[key]++
+		failures = b.failures[key]
+		b.mu.Unlock()
+	}
+
+	if class == classRateLimited {
+		if retryAfter > 0 {
+			return retryAfter
+		}
+		return rateLimitedBackoff.delay(failures)
+	}
+	return transientBackoff.delay(failures)
+}
+
+// reset forgets failures of the workload (on success or permanent failure)
+func (b *backoffTracker) reset(key workloadRef) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	delete(b.failures, key)
+	b.mu.Unlock()
+}
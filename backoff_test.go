@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Test_copyErrorsClass checks how failures of several images determine retry of the reconcile
+func Test_copyErrorsClass(t *testing.T) {
+	notFound := &copyError{class: classifyError(fmt.Errorf("wrapped: %w", &transport.Error{StatusCode: http.StatusNotFound}))}
+	unauthorized := &copyError{class: classifyError(&transport.Error{
+		StatusCode: http.StatusBadRequest,
+		Errors:     []transport.Diagnostic{{Code: transport.UnauthorizedErrorCode}},
+	})}
+	rateLimited := &copyError{class: classifyError(&transport.Error{StatusCode: http.StatusTooManyRequests}), retryAfter: time.Minute}
+	transient := &copyError{class: classifyError(fmt.Errorf("connection reset"))}
+
+	tests := []struct {
+		title      string
+		errs       copyErrors
+		class      errorClass
+		retryAfter time.Duration
+	}{
+		{title: "all not found", errs: copyErrors{notFound, notFound}, class: classNotFound},
+		{title: "permanent mix", errs: copyErrors{notFound, unauthorized}, class: classUnauthorized},
+		{title: "transient wins over permanent", errs: copyErrors{unauthorized, transient}, class: classTransient},
+		{title: "rate limit wins", errs: copyErrors{transient, rateLimited, notFound}, class: classRateLimited, retryAfter: time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			class, retryAfter := test.errs.class()
+			require.Equal(t, test.class, class)
+			require.Equal(t, test.retryAfter, retryAfter)
+		})
+	}
+
+	require.Equal(t, 5*time.Minute, transientBackoff.delay(100))
+	require.Equal(t, 12*time.Second, transientBackoff.delay(3))
+	require.Equal(t, 30*time.Second, parseRetryAfter("30"))
+}
+
+// Test_reconcilePermanentFailure checks workload, images of which are missing upstream, is not requeued
+func Test_reconcilePermanentFailure(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	image := u.Host + "/library/missing:1.0"
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+			},
+		},
+	}
+	r := &reconciler{
+		client:              fake.NewClientBuilder().WithObjects(deployment).Build(),
+		backupRegistry:      u.Host + "/backup",
+		maxConcurrentCopies: 1,
+		backoff:             newBackoffTracker(),
+	}
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: "web"}}
+
+	result, err := r.forKind(workloadKinds["Deployment"]).Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	require.Equal(t, reconcile.Result{}, result, "not found upstream image is not retried")
+	require.Empty(t, r.backoff.failures)
+
+	current := &appsv1.Deployment{}
+	require.NoError(t, r.client.Get(context.Background(), request.NamespacedName, current))
+	require.Equal(t, image, current.Spec.Template.Spec.Containers[0].Image)
+	failed := meta.FindStatusCondition(conditionsOf(current), conditionBackupFailed)
+	require.NotNil(t, failed)
+	require.Equal(t, classNotFound.String(), failed.Reason)
+}
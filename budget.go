@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceWindow is a daily time range (UTC), optionally restricted to some weekdays.
+// Range may wrap midnight (i.e. 22:00-06:00), then weekday is the day the window starts
+type maintenanceWindow struct {
+	days       map[time.Weekday]struct{} //empty means every day
+	start, end time.Duration             //since midnight
+}
+
+// weekdays by their short names
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseMaintenanceWindow parses window as `[days ]HH:MM-HH:MM`, where days
+// are comma separated weekdays or ranges, i.e. `Mon-Fri 22:00-06:00`, `Sat,Sun 00:00-24:00`
+func parseMaintenanceWindow(value string) (maintenanceWindow, error) {
+	w := maintenanceWindow{days: map[time.Weekday]struct{}{}}
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("expected [days ]HH:MM-HH:MM, got %q", value)
+	}
+
+	if len(fields) == 2 {
+		for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+			bounds := strings.SplitN(part, "-", 2)
+			first, known := weekdays[bounds[0]]
+			if !known {
+				return w, fmt.Errorf("unknown weekday %q in %q", bounds[0], value)
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, known = weekdays[bounds[1]]; !known {
+					return w, fmt.Errorf("unknown weekday %q in %q", bounds[1], value)
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = struct{}{}
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	bounds := strings.SplitN(fields[len(fields)-1], "-", 2)
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("expected HH:MM-HH:MM in %q", value)
+	}
+	var err error
+	if w.start, err = parseClock(bounds[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(bounds[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("empty window %q", value)
+	}
+	return w, nil
+}
+
+// parseClock parses HH:MM as time since midnight (24:00 is the end of the day)
+func parseClock(value string) (time.Duration, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(value, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("expected HH:MM, got %q", value)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// contains checks if the time is within the window
+func (w maintenanceWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	sinceMidnight := t.Sub(midnight)
+
+	dayMatches := func(d time.Weekday) bool {
+		if len(w.days) == 0 {
+			return true
+		}
+		_, matches := w.days[d]
+		return matches
+	}
+
+	if w.start < w.end {
+		return dayMatches(t.Weekday()) && sinceMidnight >= w.start && sinceMidnight < w.end
+	}
+	//window wraps midnight
+	if sinceMidnight >= w.start {
+		return dayMatches(t.Weekday())
+	}
+	return sinceMidnight < w.end && dayMatches((t.Weekday()+6)%7)
+}
+
+// rewriteBudget spreads rewrites of workloads (and so their rollouts) over time:
+// no more than limit workloads (namespaceLimit per namespace) are rewritten within
+// interval, and only within maintenance windows (if any).
+// NOTE! Budget is kept by every replica, so with sharding limits apply per replica
+type rewriteBudget struct {
+	interval       time.Duration
+	limit          int //zero means unlimited
+	namespaceLimit int //zero means unlimited
+	windows        []maintenanceWindow
+
+	mu       sync.Mutex
+	rewrites []budgetEntry //rewrites within the last interval
+	now      func() time.Time
+}
+
+// budgetEntry is a rewrite counted against budget
+type budgetEntry struct {
+	at        time.Time
+	namespace string
+}
+
+func newRewriteBudget(interval time.Duration, limit, namespaceLimit int, windows []maintenanceWindow) *rewriteBudget {
+	return &rewriteBudget{
+		interval:       interval,
+		limit:          limit,
+		namespaceLimit: namespaceLimit,
+		windows:        windows,
+		now:            time.Now,
+	}
+}
+
+// take reserves rewrite of workload in the namespace. If rewrite is not allowed now,
+// returns the time to wait and the reason. Nil budget allows everything
+func (b *rewriteBudget) take(namespace string) (time.Duration, string) {
+	if b == nil {
+		return 0, ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if wait := b.untilWindow(now); wait > 0 {
+		return wait, "outside of maintenance windows"
+	}
+
+	//Forget rewrites out of the interval
+	kept := b.rewrites[:0]
+	for _, e := range b.rewrites {
+		if now.Sub(e.at) < b.interval {
+			kept = append(kept, e)
+		}
+	}
+	b.rewrites = kept
+
+	if b.limit > 0 && len(b.rewrites) >= b.limit {
+		return b.interval - now.Sub(b.rewrites[len(b.rewrites)-b.limit].at), fmt.Sprintf("%d workloads rewritten within %s", len(b.rewrites), b.interval)
+	}
+	if b.namespaceLimit > 0 {
+		var inNamespace []time.Time
+		for _, e := range b.rewrites {
+			if e.namespace == namespace {
+				inNamespace = append(inNamespace, e.at)
+			}
+		}
+		if len(inNamespace) >= b.namespaceLimit {
+			return b.interval - now.Sub(inNamespace[len(inNamespace)-b.namespaceLimit]),
+				fmt.Sprintf("%d workloads of namespace %s rewritten within %s", len(inNamespace), namespace, b.interval)
+		}
+	}
+
+	b.rewrites = append(b.rewrites, budgetEntry{at: now, namespace: namespace})
+	return 0, ""
+}
+
+// refund returns rewrite reserved for the namespace (i.e. when it failed). Nil budget does nothing
+func (b *rewriteBudget) refund(namespace string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := len(b.rewrites) - 1; i >= 0; i-- {
+		if b.rewrites[i].namespace == namespace {
+			b.rewrites = append(b.rewrites[:i], b.rewrites[i+1:]...)
+			return
+		}
+	}
+}
+
+// untilWindow returns time until the nearest maintenance window opens (zero if within one)
+func (b *rewriteBudget) untilWindow(now time.Time) time.Duration {
+	if len(b.windows) == 0 {
+		return 0
+	}
+	//Windows are minute aligned, so minute steps over a week find the nearest one
+	for wait := time.Duration(0); wait <= 8*24*time.Hour; wait += time.Minute {
+		t := now.Add(wait)
+		if wait > 0 {
+			t = t.Truncate(time.Minute)
+		}
+		for _, w := range b.windows {
+			if w.contains(t) {
+				return t.Sub(now)
+			}
+		}
+	}
+	return b.interval
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_maintenanceWindow checks parsing of windows and wrapping of midnight
+func Test_maintenanceWindow(t *testing.T) {
+	w, err := parseMaintenanceWindow("Mon-Fri 22:00-06:00")
+	require.NoError(t, err)
+	require.Len(t, w.days, 5)
+
+	monday := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	require.False(t, w.contains(monday.Add(3*time.Hour)))           //Monday 03:00, window started on Sunday
+	require.True(t, w.contains(monday.Add(23*time.Hour)))           //Monday 23:00
+	require.True(t, w.contains(monday.Add(24*time.Hour+time.Hour))) //Tuesday 01:00
+	require.False(t, w.contains(monday.Add(12*time.Hour)))
+
+	w, err = parseMaintenanceWindow("Sat,Sun 00:00-24:00")
+	require.NoError(t, err)
+	require.True(t, w.contains(monday.Add(-time.Hour)))
+
+	for _, invalid := range []string{"", "Mon", "Funday 10:00-11:00", "10:00-10:00", "25:00-26:00", "Mon Tue 10:00-11:00"} {
+		_, err := parseMaintenanceWindow(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+// Test_rewriteBudget checks global and per namespace limits, and waiting for maintenance windows
+func Test_rewriteBudget(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC) //Monday
+	b := newRewriteBudget(10*time.Minute, 3, 2, nil)
+	b.now = func() time.Time { return now }
+
+	for _, ns := range []string{"a", "a", "b"} {
+		wait, _ := b.take(ns)
+		require.Zero(t, wait)
+	}
+	wait, _ := b.take("c")
+	require.Equal(t, 10*time.Minute, wait)
+
+	now = now.Add(10 * time.Minute)
+	wait, _ = b.take("a")
+	require.Zero(t, wait)
+	wait, _ = b.take("a")
+	require.Zero(t, wait)
+	wait, reason := b.take("a")
+	require.Equal(t, 10*time.Minute, wait)
+	require.Contains(t, reason, "namespace a")
+	b.refund("a")
+	wait, _ = b.take("a")
+	require.Zero(t, wait)
+
+	w, err := parseMaintenanceWindow("22:00-06:00")
+	require.NoError(t, err)
+	b = newRewriteBudget(10*time.Minute, 0, 0, []maintenanceWindow{w})
+	b.now = func() time.Time { return now }
+	wait, _ = b.take("a")
+	require.Equal(t, 9*time.Hour+50*time.Minute, wait)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+const (
+	// statusAnnotation holds JSON list of conditions of the workload, as set by the controller
+	statusAnnotation = "imgclonectrl.io/status"
+	// protectedAnnotation is "true" when all images of the workload are backed up
+	protectedAnnotation = "imgclonectrl.io/protected"
+
+	// conditionImagesBackedUp - all images of the workload are in backup registry
+	conditionImagesBackedUp = "ImagesBackedUp"
+	// conditionSpecRewritten - workload uses images from backup registry
+	conditionSpecRewritten = "SpecRewritten"
+	// conditionBackupFailed - the last backup attempt failed, reason is the class of failure
+	conditionBackupFailed = "BackupFailed"
+)
+
+// condition returns condition of the type
+func condition(conditionType string, status bool, reason, message string) metav1.Condition {
+	c := metav1.Condition{Type: conditionType, Status: metav1.ConditionFalse, Reason: reason, Message: message}
+	if status {
+		c.Status = metav1.ConditionTrue
+	}
+	return c
+}
+
+// conditionsOf returns conditions of the object, stored in status annotation
+func conditionsOf(obj client.Object) []metav1.Condition {
+	var conditions []metav1.Condition
+	if value, exists := obj.GetAnnotations()[statusAnnotation]; exists {
+		//malformed annotation is overwritten
+		_ = json.Unmarshal([]byte(value), &conditions)
+	}
+	return conditions
+}
+
+// setConditions sets conditions of the object (transition time is kept, unless status changes)
+// and updates status annotations. Returns true, if annotations changed
+func setConditions(obj client.Object, updates ...metav1.Condition) bool {
+	conditions := conditionsOf(obj)
+	for _, c := range updates {
+		c.ObservedGeneration = obj.GetGeneration()
+		meta.SetStatusCondition(&conditions, c)
+	}
+
+	value, _ := json.Marshal(conditions)
+	protected := "false"
+	if meta.IsStatusConditionTrue(conditions, conditionImagesBackedUp) {
+		protected = "true"
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations[statusAnnotation] == string(value) && annotations[protectedAnnotation] == protected {
+		return false
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[statusAnnotation] = string(value)
+	annotations[protectedAnnotation] = protected
+	obj.SetAnnotations(annotations)
+	return true
+}
+
+// patchConditions sets conditions of the object and writes status annotations only
+// (with merge patch, so other changes of the object are not written)
+func (r *reconciler) patchConditions(ctx context.Context, obj client.Object, updates ...metav1.Condition) error {
+	base := obj.DeepCopyObject().(client.Object)
+	if !setConditions(obj, updates...) {
+		return nil
+	}
+	return r.client.Patch(ctx, obj, client.MergeFrom(base), client.FieldOwner(fieldManager))
+}
+
+// statusOnlyChange checks if the update changed status annotations only, as written by controller itself
+func statusOnlyChange(oldObj, newObj client.Object) bool {
+	if oldObj == nil || newObj == nil || oldObj.GetGeneration() != newObj.GetGeneration() {
+		return false
+	}
+	oldAnnotations, newAnnotations := oldObj.GetAnnotations(), newObj.GetAnnotations()
+	if oldAnnotations[statusAnnotation] == newAnnotations[statusAnnotation] &&
+		oldAnnotations[protectedAnnotation] == newAnnotations[protectedAnnotation] {
+		return false
+	}
+	return reflect.DeepEqual(withoutStatus(oldAnnotations), withoutStatus(newAnnotations))
+}
+
+// withoutStatus returns copy of annotations without status annotations
+func withoutStatus(annotations map[string]string) map[string]string {
+	result := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		if key != statusAnnotation && key != protectedAnnotation {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// ignoreStatusUpdates filters out updates of status annotations, so writing them
+// does not trigger reconcile (and retry, bypassing backoff) of the workload
+var ignoreStatusUpdates = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return !statusOnlyChange(e.ObjectOld, e.ObjectNew)
+	},
+}
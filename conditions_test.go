@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Test_setConditions checks conditions are stored in annotations, and writing them again does not change anything
+func Test_setConditions(t *testing.T) {
+	obj := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test", Generation: 3}}
+
+	require.True(t, setConditions(obj,
+		condition(conditionImagesBackedUp, false, "RateLimited", "not all images are in backup registry"),
+		condition(conditionBackupFailed, true, "RateLimited", "too many requests")))
+	require.Equal(t, "false", obj.GetAnnotations()[protectedAnnotation])
+	failed := meta.FindStatusCondition(conditionsOf(obj), conditionBackupFailed)
+	require.NotNil(t, failed)
+	require.Equal(t, metav1.ConditionTrue, failed.Status)
+	require.Equal(t, int64(3), failed.ObservedGeneration)
+
+	old := obj.DeepCopy()
+	require.False(t, setConditions(obj, condition(conditionBackupFailed, true, "RateLimited", "too many requests")))
+
+	require.True(t, setConditions(obj,
+		condition(conditionImagesBackedUp, true, "BackedUp", "all images are in backup registry"),
+		condition(conditionBackupFailed, false, "BackedUp", "")))
+	require.Equal(t, "true", obj.GetAnnotations()[protectedAnnotation])
+	require.Len(t, conditionsOf(obj), 2)
+
+	//controller's own status writes do not trigger reconcile, other changes do
+	require.True(t, statusOnlyChange(old, obj))
+	obj.Annotations["team"] = "web"
+	require.False(t, statusOnlyChange(old, obj))
+}
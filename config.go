@@ -3,7 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -15,6 +17,54 @@ var (
 	//Leader election
 	argLeaderElectionID        string
 	argLeaderElectionNamespace string
+	argSharding                bool
+	argShardLeaseDuration      time.Duration
+	//Concurrency
+	argMaxConcurrentReconciles int
+	argMaxConcurrentCopies     int
+	argRegistryConcurrency     = flagIntMap{}
+	argDefaultRegistryLimit    int
+	argCopyCacheTTL            time.Duration
+	argDigestCacheTTL          time.Duration
+	//Transfer of images
+	argBlobRetries       int
+	argCopyTimeoutBase   time.Duration
+	argMinCopyThroughput int
+	//Rewrite of workload specs
+	argRewriteMode          string
+	argStandbyProbeInterval time.Duration
+	argStandbyRevert        bool
+	argTagMutationPolicy    string
+	argRolloutDeadline      time.Duration
+	argRolloutCheckInterval time.Duration
+
+	argRewriteBudget             int
+	argRewriteBudgetPerNamespace int
+	argRewriteBudgetInterval     time.Duration
+	argMaintenanceWindows        = flagSet{}
+
+	argPodRescue string
+
+	argWorkloadKinds = flagSet{}
+
+	argNamespaceSelector       string
+	argIgnoreNamespaceSelector string
+	argWatchNamespaces         = flagSet{}
+
+	argIncludeImages     = flagSet{}
+	argExcludeImages     = flagSet{}
+	argIncludeRegistries = flagSet{}
+	argExcludeRegistries = flagSet{}
+	//Periodic jobs
+	argUpstreamCheckInterval time.Duration
+	argVerifyInterval        time.Duration
+	argGCInterval            time.Duration
+	argGCRetention           time.Duration
+	argGCDryRun              bool
+	argGCProtectTags         = flagSet{}
+
+	argInventoryNamespace    string
+	argInventorySyncInterval time.Duration
 )
 
 type flagSet map[string]struct{}
@@ -40,11 +90,51 @@ func (i *flagSet) Set(value string) error {
 	return nil
 }
 
+// flagIntMap holds `key=N` pairs passed via repeated flag
+type flagIntMap map[string]int
+
+func (m *flagIntMap) String() string {
+	if *m == nil {
+		return ""
+	}
+	b := strings.Builder{}
+
+	for key, value := range *m {
+		fmt.Fprintf(&b, "%s=%d,", key, value)
+	}
+
+	if b.String() != "" {
+		return b.String()[:b.Len()-1]
+	}
+	return ""
+}
+
+func (m *flagIntMap) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected key=N, got %q", value)
+	}
+
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n < 1 {
+		return fmt.Errorf("expected positive integer in %q", value)
+	}
+
+	(*m)[parts[0]] = n
+	return nil
+}
+
 func init() {
 	//Setting up flags
 	flag.BoolVar(&argPrintVersion, "version", false, "Print version")
 	flag.Var(&argIgnoreNamespaces, "ignoreNamespace",
 		"Name of namespace to ignore. Multiple values supported.")
+	flag.StringVar(&argNamespaceSelector, "namespaceSelector", "",
+		"Label selector of namespaces to manage workloads in (i.e. 'imgclonectrl.io/enabled=true'). All namespaces are managed, if not set")
+	flag.StringVar(&argIgnoreNamespaceSelector, "ignoreNamespaceSelector", "",
+		"Label selector of namespaces to ignore (i.e. 'team in (infra,platform)')")
+	flag.Var(&argWatchNamespaces, "watchNamespace",
+		"Name of namespace to watch, workloads of other namespaces are not cached nor managed (namespaced RBAC is enough). All namespaces are watched, if not set. Multiple values supported.")
 	flag.StringVar(&argBackupRegistry, "backupRegistry", "",
 		"Backup registry to use (i.e. quay.io/my_favorite_registry)")
 	flag.StringVar(&argBackupRegistryUser, "backupRegistryUser", "",
@@ -56,4 +146,84 @@ func init() {
 		"Leader election ID (configmap with this name will be created)")
 	flag.StringVar(&argLeaderElectionNamespace, "leaderElectionNamespace", "",
 		"Election namespace - in which leader election ID config map will be created")
+	flag.BoolVar(&argSharding, "sharding", false,
+		"Split namespaces between replicas (consistent hashing), so every replica reconciles its own shard of workloads. Replicas join with Leases in election namespace")
+	flag.DurationVar(&argShardLeaseDuration, "shardLeaseDuration", 15*time.Second,
+		"How long shard Lease of a replica is valid without renewal, before its namespaces move to other replicas")
+
+	flag.IntVar(&argMaxConcurrentReconciles, "maxConcurrentReconciles", 1,
+		"Number of workloads reconciled in parallel")
+	flag.IntVar(&argMaxConcurrentCopies, "maxConcurrentCopies", 4,
+		"Number of images copied in parallel within a single reconcile")
+	flag.Var(&argRegistryConcurrency, "registryConcurrency",
+		"Max parallel copies from a source registry, as registry=N (i.e. docker.io=2). Multiple values supported.")
+	flag.IntVar(&argDefaultRegistryLimit, "defaultRegistryConcurrency", 4,
+		"Max parallel copies from a source registry not listed in --registryConcurrency")
+	flag.DurationVar(&argCopyCacheTTL, "copyCacheTTL", 10*time.Minute,
+		"How long successful image copy is remembered, so other workloads using the same image skip registry checks (0 disables)")
+	flag.DurationVar(&argDigestCacheTTL, "digestCacheTTL", 5*time.Minute,
+		"How long digest of a source image is cached, to save registry rate limits (0 disables)")
+
+	flag.IntVar(&argBlobRetries, "blobRetries", 5,
+		"Number of attempts to upload a single blob (layer) to backup registry")
+	flag.DurationVar(&argCopyTimeoutBase, "copyTimeoutBase", 5*time.Minute,
+		"Time given to copy any image. Time to transfer the image at --minCopyThroughput is added to it (0 disables timeout)")
+	flag.IntVar(&argMinCopyThroughput, "minCopyThroughput", 1024,
+		"Minimal expected copy throughput in KiB/s, used to derive copy timeout from image size")
+
+	flag.StringVar(&argRewriteMode, "rewriteMode", rewriteModeAlways,
+		"When workloads are switched to backup images: 'always' - right after backup, 'standby' - only when upstream image disappears, "+
+			"'deferred' - right after the next change of pod template made by workload owner (as a rollout of its own, limited by rewrite budget)")
+	flag.DurationVar(&argStandbyProbeInterval, "standbyProbeInterval", 10*time.Minute,
+		"How often upstream images are probed in standby mode")
+	flag.BoolVar(&argStandbyRevert, "standbyRevert", false,
+		"In standby mode, switch workloads back to upstream images once they are available again")
+	flag.StringVar(&argTagMutationPolicy, "tagMutationPolicy", tagMutationPreserve,
+		"What to do when upstream tag is moved to a different image: 'preserve' - keep backup, back up new image to digest suffixed tag, "+
+			"'history' - keep backup under digest suffixed tag and overwrite backup tag, 'overwrite' - overwrite backup tag")
+	flag.DurationVar(&argRolloutDeadline, "rolloutDeadline", 5*time.Minute,
+		"Time given to pods to pull backup images, before workload is reverted to upstream images (0 disables rollout watching, custom kinds are not watched)")
+	flag.DurationVar(&argRolloutCheckInterval, "rolloutCheckInterval", 15*time.Second,
+		"How often rollout of backup images is checked")
+
+	flag.IntVar(&argRewriteBudget, "rewriteBudget", 0,
+		"Max number of workloads rewritten to use backup images within --rewriteBudgetInterval, per replica with --sharding (0 means unlimited). Images are backed up regardless")
+	flag.IntVar(&argRewriteBudgetPerNamespace, "rewriteBudgetPerNamespace", 0,
+		"Max number of workloads of a namespace rewritten within --rewriteBudgetInterval (0 means unlimited)")
+	flag.DurationVar(&argRewriteBudgetInterval, "rewriteBudgetInterval", 10*time.Minute,
+		"Interval rewrite budgets are counted within")
+	flag.Var(&argMaintenanceWindows, "maintenanceWindow",
+		"Time window (UTC) workloads are rewritten within, as '[days ]HH:MM-HH:MM' (i.e. 'Mon-Fri 22:00-06:00'). Multiple values supported.")
+
+	flag.StringVar(&argPodRescue, "podRescue", podRescueEvent,
+		"What to do with pods failing to pull upstream images, that are backed up: 'event' - record event pointing at the backup, "+
+			"'patch' - switch owning Deployment or DaemonSet to the backup, 'off' - nothing")
+	flag.Var(&argIncludeImages, "includeImage",
+		"Image pattern (glob or 'regex:' prefixed regular expression) to back up, i.e. 'docker.io/library/*' ('*' matches within a path segment, '**' across segments). Multiple values supported.")
+	flag.Var(&argExcludeImages, "excludeImage",
+		"Image pattern (glob or 'regex:' prefixed regular expression) not to back up. Multiple values supported.")
+	flag.Var(&argIncludeRegistries, "includeRegistry",
+		"Source registry pattern (glob or 'regex:' prefixed regular expression) to back up images of. Multiple values supported.")
+	flag.Var(&argExcludeRegistries, "excludeRegistry",
+		"Source registry pattern (glob or 'regex:' prefixed regular expression) not to back up images of, i.e. '*.dkr.ecr.*.amazonaws.com'. Multiple values supported.")
+	flag.Var(&argWorkloadKinds, "workloadKind",
+		"Additional kind of workloads to manage, as 'group/version/Kind=path.to.pod.spec' (i.e. 'argoproj.io/v1alpha1/Rollout=spec.template.spec'). Multiple values supported.")
+
+	flag.DurationVar(&argUpstreamCheckInterval, "upstreamCheckInterval", time.Hour,
+		"How often backed up images are checked for being deleted or moved upstream (0 disables)")
+	flag.DurationVar(&argVerifyInterval, "verifyInterval", 24*time.Hour,
+		"How often backups are verified to be intact in backup registry, broken ones are pushed again from upstream (0 disables)")
+	flag.DurationVar(&argGCInterval, "gcInterval", 0,
+		"How often backup images not referenced by any workload are garbage collected (0 disables)")
+	flag.DurationVar(&argGCRetention, "gcRetention", 30*24*time.Hour,
+		"How long backup image must stay unreferenced to be garbage collected")
+	flag.BoolVar(&argGCDryRun, "gcDryRun", false,
+		"Only log backup images that would be garbage collected")
+	flag.Var(&argGCProtectTags, "gcProtectTag",
+		"Glob pattern of backup tags never garbage collected (i.e. 'library_postgres_*'). Multiple values supported.")
+
+	flag.StringVar(&argInventoryNamespace, "inventoryNamespace", "",
+		"Namespace of ClonedImage resources, holding inventory of backed up images (defaults to NAMESPACE env variable)")
+	flag.DurationVar(&argInventorySyncInterval, "inventorySyncInterval", 30*time.Second,
+		"How often inventory changes are persisted as ClonedImage resources (0 disables)")
 }
@@ -21,7 +21,9 @@ import (
 	"fmt"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
@@ -29,90 +31,97 @@ import (
 	crv1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 
-	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
-// withKind is used to enrich reconcile.Request
-// with `kind` of object to be queued
-// This does the trick to use the single handler with
-// different objects (Deployment and DemonSet)
-func withKind(obj client.Object) []reconcile.Request {
-	kind := "DaemonSet"
-	if _, isDeployment := obj.(*appsv1.Deployment); isDeployment {
-		kind = "Deployment"
-	}
-
-	return []reconcile.Request{{
-		NamespacedName: types.NamespacedName{
-			Name:      fmt.Sprintf("%s:%s", kind, obj.GetName()),
-			Namespace: obj.GetNamespace(),
-		},
-	}}
-}
-
-// reconciler reconciles Deployment & DaemonSet
+// reconciler reconciles workloads (Deployment, DaemonSet and custom kinds)
 type reconciler struct {
 	// client can be used to retrieve objects from the APIServer.
-	client             client.Client
-	ignoredNamespaces  map[string]struct{} //set of ignored namespaces
-	backupRegistry     string              //backup registry
-	authConfig         authn.AuthConfig    //config to authn against backup registry
-
+	client               client.Client
+	ignoredNamespaces    map[string]struct{} //set of ignored namespaces
+	namespaceSelector    labels.Selector     //labels of namespaces to manage, nil manages all
+	ignoreSelector       labels.Selector     //labels of namespaces to ignore, nil ignores none
+	namespaceScoped      bool                //cache is restricted to watched namespaces, so namespaces are read directly
+	backupRegistry       string              //backup registry
+	authConfig           authn.AuthConfig    //config to authn against backup registry
+	maxConcurrentCopies  int                 //parallel image copies within single reconcile
+	registryLimiter      *registryLimiter    //per source registry limits, shared by all workers
+	copyCoordinator      *copyCoordinator    //deduplication of image copies, shared by all workers
+	digests              *digestCache        //digests of source images, shared by all workers
+	backoff              *backoffTracker     //consecutive failures of workloads
+	blobRetries          int                 //attempts to upload single blob
+	copyTimeoutBase      time.Duration       //time given to copy any image, zero means no timeout
+	minCopyThroughput    int64               //bytes per second, expected from registries to calculate copy timeout
+	rewriteMode          string              //when specs are rewritten to use backup images (always, standby, deferred)
+	probeInterval        time.Duration       //standby mode: how often upstream images are probed
+	standbyRevert        bool                //standby mode: switch back to upstream image, once it's available again
+	inventory            *inventory          //backed up images and workloads using them
+	tagMutationPolicy    string              //what to do with backup, when upstream tag is moved (preserve, history, overwrite)
+	rolloutDeadline      time.Duration       //time given to pods to pull backup images, before workload is reverted. Zero disables
+	rolloutCheckInterval time.Duration       //how often rollout of backup images is checked
+	apiReader            client.Reader       //uncached reader (i.e. for pods), client is used if not set
+	rewriteBudget        *rewriteBudget      //limits of rewrites per interval and maintenance windows, shared by all workers
+	imageFilter          *imageFilter        //images and registries to be backed up or skipped, nil backs up everything
+	registries           *backupRegistries   //backup registries of namespaces and their credentials, shared by all workers
+	shards               *shardMembership    //namespaces reconciled by this replica, nil reconciles all
+	namespaces           client.Reader       //namespaces read within a reconcile (see readingNamespacesOnce), nil reads them every time
+	registryFallback     string              //why backup registry of the namespace is not known and default one is used (see forNamespace)
+	recorder             record.EventRecorder
 }
 
-// Implement reconcile.Reconciler so the controller can reconcile objects
-var _ reconcile.Reconciler = &reconciler{}
-
-// fetchObjectFromRequest returns client.Object.
-// Content of request is examined against holding either Deployment or DaemonSet.
-func (r *reconciler) fetchObjectFromRequest(ctx context.Context, request reconcile.Request) (client.Object, error) {
-	var (
-		err error
-		dp  = &appsv1.Deployment{}
-		ds  = &appsv1.DaemonSet{}
-		//obj = make([]client.Object, 0, len(mgdObjectsTypes))
-		obj                   client.Object
-		parts                 []string
-		kind, name            string
-		genericNamespacedName types.NamespacedName
-	)
-
-	//request.NamespacedName.Name holds kind:Name
-	parts = strings.SplitN(request.NamespacedName.Name, ":", 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("could not parse kind and name from request.NamespacedName: %+v", request.NamespacedName)
-	}
+// forKind returns reconciler of workloads of the kind, to be run by controller of the kind.
+// Requests are keys of the objects, kind is known from the controller
+func (r *reconciler) forKind(adapter workloadAdapter) reconcile.Reconciler {
+	return reconcile.Func(func(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+		ref := workloadRef{Kind: adapter.kind(), Namespace: request.Namespace, Name: request.Name}
+		return r.reconcileWorkload(ctx, ref)
+	})
+}
 
-	kind = parts[0]
-	name = parts[1]
-	genericNamespacedName = types.NamespacedName{
-		Name:      name,
-		Namespace: request.NamespacedName.Namespace,
-	}
+// workloadOf returns reference to the workload object
+func workloadOf(obj client.Object) workloadRef {
+	return workloadRef{Kind: kindOf(obj), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+}
 
-	switch kind {
-	case "Deployment":
-		err = r.client.Get(ctx, genericNamespacedName, dp)
-		obj = dp
-	case "DaemonSet":
-		err = r.client.Get(ctx, genericNamespacedName, ds)
-		obj = ds
+// fetchWorkload returns the workload object
+func (r *reconciler) fetchWorkload(ctx context.Context, ref workloadRef) (client.Object, error) {
+	obj, err := newWorkload(ref.Kind)
+	if err != nil {
+		return nil, err
 	}
 
+	key := types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}
+	err = r.client.Get(ctx, key, obj)
 	if errors.IsNotFound(err) {
-		return nil, fmt.Errorf("could not find %s, %s", kind, genericNamespacedName.String())
+		return nil, fmt.Errorf("could not find %s, %s: %w", ref.Kind, key.String(), err)
 	}
 	if err != nil { //some other general errors
-		return nil, fmt.Errorf("could not fetch %s: %+v", kind, err)
+		return nil, fmt.Errorf("could not fetch %s: %w", ref.Kind, err)
 	}
 
 	return obj, nil
 }
 
+// referencedImages returns images (src -> dst) the object uses: either upstream images
+// to be backed up, or backup images it was rewritten to use
+func (r *reconciler) referencedImages(obj client.Object) map[string]string {
+	images := map[string]string{}
+	if podSpec, err := podSpecOf(obj); err == nil {
+		images = r.imagesToBackup(podSpec)
+	}
+
+	sources, _ := sourceImages(obj)
+	for dst, src := range sources {
+		images[src] = dst
+	}
+	return images
+}
+
 // getTargetImage renders target image (using backup registry) from source image
 // Note that destination image is flattened to have only name and tag, as backup
 // registry can lack of support of nested registries
@@ -146,122 +155,363 @@ func (r *reconciler) getTargetImage(srcImageFull string) string {
 
 }
 
-// updateSpecWithImage updates images in an object spec
-// 2 types of objects supported - Deployment and DaemonSet
-// The function returns a mapping (map[string]string) that can determine for every
-// source image it's destination (from backup registry) counterpart.
-// If the image is already updated to backup registry, it is not added to the map
-func (r *reconciler) updateSpecWithImage(obj client.Object) (map[string]string, error) {
-	var (
-		imageSrcDst = map[string]string{} //mapping of src image -> dst image
-		podSpec     v1.PodSpec
-	)
-	switch obj.GetObjectKind().GroupVersionKind().Kind {
-	case "Deployment":
-		dp, isDeployment := obj.(*appsv1.Deployment)
-		if !isDeployment {
-			return nil, fmt.Errorf("object is not of type *appsv1.Deployment")
-		}
-		podSpec = dp.Spec.Template.Spec
+// imagesToBackup returns a mapping (map[string]string) that can determine for every
+// source image of the pod spec it's destination (from backup registry) counterpart.
+// If the image is already updated to backup registry or filtered out, it is not added to the map
+func (r *reconciler) imagesToBackup(podSpec *v1.PodSpec) map[string]string {
+	imageSrcDst := map[string]string{} //mapping of src image -> dst image
 
-	case "DaemonSet":
-		ds, isDaemonSet := obj.(*appsv1.DaemonSet)
-		if !isDaemonSet {
-			return nil, fmt.Errorf("object is not of type *appsv1.DaemonSet")
+	for _, c := range podSpec.Containers {
+		if !r.shouldBackup(c.Image) { //already updated or filtered out
+			continue
 		}
-		podSpec = ds.Spec.Template.Spec
+		imageSrcDst[c.Image] = r.getTargetImage(c.Image)
 	}
 
-	for i, c := range podSpec.Containers {
-		if strings.Contains(c.Image, r.backupRegistry) { //already updated
+	for _, c := range podSpec.InitContainers {
+		if !r.shouldBackup(c.Image) { //already updated or filtered out
 			continue
 		}
 		imageSrcDst[c.Image] = r.getTargetImage(c.Image)
-		podSpec.Containers[i].Image = imageSrcDst[c.Image]
+	}
+
+	return imageSrcDst
+}
+
+// rewriteImages replaces images of the pod spec according to the mapping
+func rewriteImages(podSpec *v1.PodSpec, mapping map[string]string) {
+	for i, c := range podSpec.Containers {
+		if image, found := mapping[c.Image]; found {
+			podSpec.Containers[i].Image = image
+		}
 	}
 
 	for i, c := range podSpec.InitContainers {
-		if strings.Contains(c.Image, r.backupRegistry) { //already updated
-			continue
+		if image, found := mapping[c.Image]; found {
+			podSpec.InitContainers[i].Image = image
 		}
-		imageSrcDst[c.Image] = r.getTargetImage(c.Image)
-		podSpec.InitContainers[i].Image = imageSrcDst[c.Image]
 	}
+}
+
+// updateSpecWithImage updates images in an object spec
+// 2 types of objects supported - Deployment and DaemonSet
+// The function returns a mapping (map[string]string) that can determine for every
+// source image it's destination (from backup registry) counterpart.
+// If the image is already updated to backup registry, it is not added to the map.
+// Source images of rewritten containers are stored in sourceImagesAnnotation
+func (r *reconciler) updateSpecWithImage(obj client.Object) (map[string]string, error) {
+	podSpec, err := podSpecOf(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	imageSrcDst := r.imagesToBackup(podSpec)
+	if err := rewriteWorkloadImages(obj, imageSrcDst); err != nil {
+		return nil, err
+	}
+
+	//Remember source images, so references to backups are known after controller restart
+	sources, _ := sourceImages(obj)
+	for src, dst := range imageSrcDst {
+		sources[dst] = src
+	}
+	setSourceImages(obj, sources)
 
 	return imageSrcDst, nil
 }
 
-// pushImagesToBackupRegistry pushes image to backup registry
+// pushImagesToBackupRegistry pushes images to backup registry.
+// Images are copied in parallel (up to maxConcurrentCopies), while
+// registryLimiter caps parallel copies per source registry and
+// copyCoordinator makes sure the same image is not copied twice.
+// Failures are returned as copyErrors, classified for retry.
 func (r *reconciler) pushImagesToBackupRegistry(ctx context.Context, imageSrcDst map[string]string) error {
 	var (
-		dstAuthOpts    remote.Option
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs copyErrors
+	)
+
+	workers := r.maxConcurrentCopies
+	if workers < 1 {
+		workers = 1
+	}
+	slots := make(chan struct{}, workers)
+
+	for srcName, dstName := range imageSrcDst {
+		wg.Add(1)
+		go func(srcName, dstName string) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			err := r.copyCoordinator.run(ctx, srcName, dstName, func(ctx context.Context) error {
+				return r.copyImage(ctx, srcName, dstName)
+			})
+			if err == nil {
+				return
+			}
+
+			cerr, classified := err.(*copyError)
+			if !classified {
+				cerr = &copyError{class: classTransient, err: err}
+			}
+			mu.Lock()
+			errs = append(errs, cerr)
+			mu.Unlock()
+		}(srcName, dstName)
+	}
+	wg.Wait()
+
+	if len(errs) != 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		return errs
+	}
+	return nil
+}
+
+// copyImage copies single image from source to backup registry,
+// unless backup registry already holds the same image.
+// If backup holds different image (upstream tag was moved), tagMutationPolicy applies.
+// Returned error is always *copyError
+func (r *reconciler) copyImage(ctx context.Context, srcName, dstName string) error {
+	var (
 		err            error
 		srcRef, dstRef name.Reference
 		srcImg         crv1.Image
 	)
 
 	lg := log.FromContext(ctx)
-
-	for srcName, dstName := range imageSrcDst {
-		srcRef, err = name.ParseReference(srcName)
-		if err != nil {
-			return fmt.Errorf("could not parse source image %q", srcName)
+	//rt keeps Retry-After of rate limited requests
+	rt := newRetryAfterTransport()
+	failure := func(err error, format string, args ...interface{}) error {
+		return &copyError{
+			class:      classifyError(err),
+			retryAfter: rt.last(),
+			err:        fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), err),
 		}
+	}
 
-		dstRef, err = name.ParseReference(dstName)
-		if err != nil {
-			return fmt.Errorf("could not parse destiantion image %q", srcName)
-		}
+	srcRef, err = name.ParseReference(srcName)
+	if err != nil {
+		return &copyError{class: classInvalidReference, err: fmt.Errorf("could not parse source image %q: %w", srcName, err)}
+	}
 
-		srcImg, err = remote.Image(srcRef, remote.WithAuth(authn.Anonymous), remote.WithContext(ctx))
+	dstRef, err = name.ParseReference(dstName)
+	if err != nil {
+		return &copyError{class: classInvalidReference, err: fmt.Errorf("could not parse destiantion image %q: %w", dstName, err)}
+	}
+
+	//Respect per registry limits, before touching source registry
+	if r.registryLimiter != nil {
+		release, err := r.registryLimiter.acquire(ctx, srcRef.Context().RegistryStr())
 		if err != nil {
-			return fmt.Errorf("could not get image %q from registry ", srcName)
+			return failure(err, "could not acquire copy slot for %q", srcName)
 		}
+		defer release()
+	}
 
-		//Check if backup repository has the source image already
-		if dstImg, err := remote.Image(dstRef, remote.WithAuth(authn.Anonymous), remote.WithContext(ctx)); err == nil {
+	//Whole copy is cancelled, once time given to copy the image is over (see limitCopy)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-			if dstHash, err := dstImg.Digest(); err == nil {
-				//Checking if dstHash is equal to srcHash
-				if srcHash, err := srcImg.Digest(); err == nil && srcHash == dstHash {
-					lg.Info(fmt.Sprintf("source image %q is already in backup registry", srcName))
-					continue
-				}
-			}
+	srcOpts := []remote.Option{remote.WithAuth(authn.Anonymous), remote.WithTransport(rt), remote.WithContext(ctx)}
+
+	dstOpts := []remote.Option{r.backupAuth(), remote.WithTransport(rt), remote.WithContext(ctx)}
 
+	//Digests are compared using HEAD requests (and cache), that are not
+	//counted against registry pull rate limits
+	srcHash, err := r.sourceDigest(srcRef, srcOpts...)
+	if err != nil {
+		return failure(err, "could not get image %q from registry", srcName)
+	}
+
+	//Check if backup repository has the source image already
+	dstHash, dstErr := targetDigest(dstRef, dstOpts...)
+	if dstErr == nil && dstHash == srcHash {
+		lg.Info(fmt.Sprintf("source image %q is already in backup registry", srcName))
+		r.inventory.recordBackup(srcName, dstName, srcHash.String())
+		return nil
+	}
+
+	//Backup tag holds different image, i.e. upstream tag was moved.
+	//With preserve policy new image goes to the digest suffixed tag, which may be there already
+	mutated := dstErr == nil
+	if mutated && r.tagMutationPolicy == tagMutationPreserve {
+		if historyRef, err := historyTag(dstRef, srcHash); err == nil {
+			if digest, err := targetDigest(historyRef, dstOpts...); err == nil && digest == srcHash {
+				lg.Info(fmt.Sprintf("source image %q is already in backup registry as %q", srcName, historyRef.String()))
+				r.inventory.setUpstream(srcName, dstName, upstreamMoved, srcHash.String())
+				return nil
+			}
 		}
+	}
+
+	manifestRequests.WithLabelValues(srcRef.Context().RegistryStr()).Inc()
+	srcImg, err = remote.Image(srcRef, srcOpts...)
+	if err != nil {
+		return failure(err, "could not get image %q from registry", srcName)
+	}
+	//Tag could be moved after its digest was cached
+	srcHash, err = srcImg.Digest()
+	if err != nil {
+		return failure(err, "could not get digest of image %q", srcName)
+	}
+	r.digests.put(srcRef.String(), srcHash)
 
-		//Authentication for backup registry
-		if r.authConfig.Username == "" || r.authConfig.Password == "" {
-			dstAuthOpts = remote.WithAuth(authn.Anonymous)
-		} else {
-			dstAuthOpts = remote.WithAuth(authn.FromConfig(r.authConfig))
+	if mutated && dstHash == srcHash { //cached digest was stale
+		lg.Info(fmt.Sprintf("source image %q is already in backup registry", srcName))
+		r.inventory.recordBackup(srcName, dstName, srcHash.String())
+		return nil
+	}
+
+	if mutated {
+		tagMutations.WithLabelValues(r.tagMutationPolicy).Inc()
+		switch r.tagMutationPolicy {
+		case tagMutationPreserve:
+			historyRef, err := historyTag(dstRef, srcHash)
+			if err != nil {
+				return &copyError{class: classInvalidReference, err: err}
+			}
+			lg.Info(fmt.Sprintf("upstream image %q was moved to %s, backup %q is preserved, new image goes to %q",
+				srcName, srcHash, dstName, historyRef.String()))
+			dstRef = historyRef
+		case tagMutationHistory:
+			if err := keepHistory(ctx, dstRef, dstHash, dstOpts...); err != nil {
+				return failure(err, "could not keep previous backup %q", dstName)
+			}
+		default:
+			lg.Info(fmt.Sprintf("upstream image %q was moved to %s, overwriting backup %q", srcName, srcHash, dstName))
 		}
+	}
 
-		lg.Info(fmt.Sprintf("pushing image %q to registry", dstName))
-		if err := remote.Write(dstRef, srcImg, dstAuthOpts, remote.WithContext(ctx)); err != nil {
-			return fmt.Errorf("could not push image %q to registry ", dstName)
+	lg.Info(fmt.Sprintf("pushing image %q to registry", dstRef.String()))
+	defer r.limitCopy(ctx, srcImg, dstRef.String(), cancel)()
+	if err := r.writeImage(ctx, dstRef, srcImg, dstOpts...); err != nil {
+		return failure(err, "could not push image %q to registry", dstRef.String())
+	}
+	//Preserved backup tag still holds the previous image
+	if mutated && r.tagMutationPolicy == tagMutationPreserve {
+		r.inventory.setUpstream(srcName, dstName, upstreamMoved, srcHash.String())
+	} else {
+		r.inventory.recordBackup(srcName, dstName, srcHash.String())
+		if size, err := imageSize(srcImg); err == nil {
+			r.inventory.recordDetails(srcName, dstName, size, imagePlatforms(srcImg))
 		}
 	}
 
 	return nil
 }
 
-// Reconcile - primary handler for the controller objects. It receives requests
-// pointing out to object, and process object according to controller logic
-func (r *reconciler) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+// backupAuth returns authentication option for backup registry
+func (r *reconciler) backupAuth() remote.Option {
+	return authOption(r.authConfig)
+}
+
+// retryLater determines how the failed reconcile is retried, depending on class of
+// the failure. Permanent failures are not retried (until workload changes), but reported
+// with an event. NOTE! Error is not returned to controller-runtime, since it
+// ignores RequeueAfter for failed reconciles
+func (r *reconciler) retryLater(ctx context.Context, ref workloadRef, obj client.Object, err error) reconcile.Result {
+	lg := log.FromContext(ctx)
+
+	class, retryAfter := failureClass(err)
+
+	if class.permanent() {
+		r.backoff.reset(ref)
+		lg.Error(err, "giving up, failure is permanent", "reason", class.String())
+		r.event(obj, v1.EventTypeWarning, class.String(), fmt.Sprintf("giving up on image backup: %v", err))
+		return reconcile.Result{}
+	}
+
+	delay := r.backoff.next(ref, class, retryAfter)
+	lg.Error(err, fmt.Sprintf("will retry in %s", delay), "reason", class.String())
+	r.event(obj, v1.EventTypeWarning, class.String(), fmt.Sprintf("image backup failed, will retry in %s: %v", delay, err))
+	return reconcile.Result{RequeueAfter: delay}
+}
+
+// rewriteToBackups returns change of the object, that rewrites it to use backup images.
+// It fails with errImagesChanged, if the object has images other than pushed ones
+func (r *reconciler) rewriteToBackups(pushed map[string]string) func(obj client.Object) error {
+	return func(obj client.Object) error {
+		rewritten, err := r.updateSpecWithImage(obj)
+		if err != nil {
+			return err
+		}
+		for src := range rewritten {
+			if _, isPushed := pushed[src]; !isPushed {
+				return errImagesChanged
+			}
+		}
+		setConditions(obj,
+			condition(conditionImagesBackedUp, true, "BackedUp", "all images are in backup registry"),
+			condition(conditionSpecRewritten, true, "Rewritten", "workload uses images from backup registry"),
+			condition(conditionBackupFailed, false, "BackedUp", ""))
+
+		annotations := obj.GetAnnotations()
+		if r.rolloutWatched(obj) { //rollout of backup images is watched
+			annotations[rolloutAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		}
+		if r.rewriteMode == rewriteModeDeferred {
+			if hash, err := templateHash(obj); err == nil {
+				annotations[templateHashAnnotation] = hash
+			}
+		}
+		obj.SetAnnotations(annotations)
+		return nil
+	}
+}
+
+// backupFailed writes conditions of failed backup, reason is the class of the failure
+func (r *reconciler) backupFailed(ctx context.Context, obj client.Object, err error) {
+	class, _ := failureClass(err)
+	if patchErr := r.patchConditions(ctx, obj,
+		condition(conditionImagesBackedUp, false, class.String(), "not all images are in backup registry"),
+		condition(conditionBackupFailed, true, class.String(), err.Error())); patchErr != nil {
+		log.FromContext(ctx).Error(patchErr, "could not write status")
+	}
+}
+
+// event records an event on the object, if recorder is set
+func (r *reconciler) event(obj client.Object, eventType, reason, message string) {
+	if r.recorder == nil {
+		return
+	}
+	r.recorder.Event(obj, eventType, reason, message)
+}
+
+// reconcileWorkload - primary handler for the controller objects. It receives reference
+// to the workload, and process object according to controller logic
+func (r *reconciler) reconcileWorkload(ctx context.Context, ref workloadRef) (reconcile.Result, error) {
 	var (
 		obj client.Object
 		err error
 	)
 
-	//Filter out based on namespace
-	if _, ignore := r.ignoredNamespaces[request.Namespace]; ignore {
+	// set up a convenient lg object so we don't have to type request over and over again
+	lg := log.FromContext(ctx)
+
+	//Namespaces of other shards are reconciled by other replicas
+	if !r.shards.owns(ref.Namespace) {
 		return reconcile.Result{}, nil
 	}
 
-	// set up a convenient lg object so we don't have to type request over and over again
-	lg := log.FromContext(ctx)
+	//Filter out based on namespace (name or labels)
+	r = r.readingNamespacesOnce()
+	if ignore, err := r.namespaceIgnored(ctx, ref.Namespace); ignore {
+		if err != nil {
+			lg.Error(err, "could not check namespace")
+		}
+		return reconcile.Result{}, err
+	}
+
+	//Backup registry and credentials may be overridden for the namespace
+	r, err = r.forNamespace(ctx, ref.Namespace)
+	if err != nil {
+		lg.Error(err, "could not get backup registry of namespace")
+		return reconcile.Result{}, err
+	}
 
 	//TODO: remove
 	/*
@@ -273,11 +523,51 @@ func (r *reconciler) Reconcile(ctx context.Context, request reconcile.Request) (
 	}*/
 
 	//This returns managed object based on kind
-	obj, err = r.fetchObjectFromRequest(ctx, request)
+	obj, err = r.fetchWorkload(ctx, ref)
 	if err != nil {
+		if errors.IsNotFound(err) {
+			//Workload is deleted, it does not use backup images anymore
+			r.inventory.forgetWorkload(ref)
+		}
 		lg.Error(err,"could not fetch object")
 		return reconcile.Result{}, nil
 	}
+	if r.registryFallback != "" {
+		r.event(obj, v1.EventTypeWarning, "DefaultBackupRegistry", r.registryFallback)
+	}
+	//Images of pods missing in pod template (ephemeral containers, injected sidecars) are backed up only
+	podImages, err := r.podOnlyImages(ctx, obj)
+	if err != nil {
+		lg.Error(err, "could not get images of pods")
+	}
+	references := r.referencedImages(obj)
+	for src, dst := range podImages {
+		references[src] = dst
+	}
+	r.inventory.setReferences(workloadOf(obj), references)
+	//Best effort: failure to back up images of pods does not hold back backup of the template
+	if err := r.backupPodImages(ctx, podImages); err != nil {
+		lg.Error(err, "could not push images of pods to remote registry")
+		r.event(obj, v1.EventTypeWarning, "PodImagesBackupFailed", fmt.Sprintf("could not back up images of pods: %v", err))
+	}
+
+	//In standby mode images are backed up, but specs are rewritten only on failover
+	if r.rewriteMode == rewriteModeStandby {
+		return r.reconcileStandby(ctx, ref, obj)
+	}
+
+	//Workload reverted after failed rollout is not rewritten again
+	if _, reverted := obj.GetAnnotations()[revertedAnnotation]; reverted {
+		return r.reconcileReverted(ctx, ref, obj)
+	}
+
+	//In deferred mode specs are rewritten along with changes made by owners
+	if r.rewriteMode == rewriteModeDeferred {
+		return r.reconcileDeferred(ctx, ref, obj)
+	}
+
+	//Object as fetched, status annotations are written to it, when spec is not updated
+	original := obj.DeepCopyObject().(client.Object)
 
 	//Update images in the spec, to use images from backup registry
 	imageSrcDst, err := r.updateSpecWithImage(obj)
@@ -287,7 +577,13 @@ func (r *reconciler) Reconcile(ctx context.Context, request reconcile.Request) (
 
 	if len(imageSrcDst) == 0 { //Nothing to process
 		lg.Info("already reconciled")
-		return reconcile.Result{}, nil
+		if err := r.patchConditions(ctx, original,
+			condition(conditionImagesBackedUp, true, "BackedUp", "all images are in backup registry"),
+			condition(conditionSpecRewritten, true, "Rewritten", "workload uses images from backup registry"),
+			condition(conditionBackupFailed, false, "BackedUp", "")); err != nil {
+			lg.Error(err, "could not write status")
+		}
+		return r.watchRollout(ctx, ref, original)
 	}
 
 	//Pushing images to backup registry
@@ -295,14 +591,50 @@ func (r *reconciler) Reconcile(ctx context.Context, request reconcile.Request) (
 	lg.Info("start processing images...")
 	err = r.pushImagesToBackupRegistry(ctx, imageSrcDst)
 	if err != nil {
-		return reconcile.Result{RequeueAfter: time.Second * 3}, fmt.Errorf("could not push images to remote registry (requied in 3 sec): %v", err)
+		err = fmt.Errorf("could not push images to remote registry: %w", err)
+		r.backupFailed(ctx, original, err)
+		return r.retryLater(ctx, ref, obj, err), nil
 	}
 
-	//Commit changes in object spec
-	err = r.client.Update(ctx, obj)
+	//With preserve policy backups of moved upstream tags keep the previous images
+	r.preservedEvents(ctx, obj, imageSrcDst)
+
+	//Images are backed up, but rewrite (and so rollout) may have to wait for the budget
+	if wait, reason := r.rewriteBudget.take(ref.Namespace); wait > 0 {
+		lg.Info(fmt.Sprintf("rewrite deferred for %s: %s", wait.Round(time.Second), reason))
+		if err := r.patchConditions(ctx, original,
+			condition(conditionImagesBackedUp, true, "BackedUp", "all images are in backup registry"),
+			condition(conditionSpecRewritten, false, "RewriteDeferred", reason),
+			condition(conditionBackupFailed, false, "BackedUp", "")); err != nil {
+			lg.Error(err, "could not write status")
+		}
+		r.backoff.reset(ref)
+		return reconcile.Result{RequeueAfter: wait}, nil
+	}
+
+	//Commit changes of images. If the object is changed meanwhile, images
+	//are rewritten again, unless there are new images to back up
+	err = r.patchImages(ctx, ref, obj, r.rewriteToBackups(imageSrcDst))
 	if err != nil {
-		return reconcile.Result{RequeueAfter: time.Second}, fmt.Errorf("could not write %s, (requied in 1 sec): %+v", obj.GetObjectKind().GroupVersionKind().Kind, err)
+		r.rewriteBudget.refund(ref.Namespace)
+	}
+	if err == errImagesChanged { //reconciled again, since the object changed
+		lg.Info("images changed during backup")
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("could not write %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, err)
+		if patchErr := r.patchConditions(ctx, original,
+			condition(conditionImagesBackedUp, true, "BackedUp", "all images are in backup registry"),
+			condition(conditionSpecRewritten, false, "UpdateFailed", err.Error())); patchErr != nil {
+			lg.Error(patchErr, "could not write status")
+		}
+		return r.retryLater(ctx, ref, obj, err), nil
 	}
 
+	r.backoff.reset(ref)
+	if r.rolloutDeadline > 0 {
+		return reconcile.Result{RequeueAfter: r.rolloutCheckInterval}, nil
+	}
 	return reconcile.Result{}, nil
 }
@@ -125,9 +125,9 @@ func Test_Reconcile(t *testing.T) {
 
 				r := reconcile.Request{NamespacedName: types.NamespacedName{
 					Namespace: o.GetNamespace(),
-					Name:      fmt.Sprintf("%s:%s", kind, o.GetName()),
+					Name:      o.GetName(),
 				}}
-				_, e := reconc.Reconcile(context.Background(), r)
+				_, e := reconc.forKind(workloadKinds[kind]).Reconcile(context.Background(), r)
 				require.Nil(t, e)
 
 				//Checking if reconciled object has the right image
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// copyKey identifies single image copy operation
+type copyKey struct {
+	src, dst string
+}
+
+// copyCall is an in-flight copy, other requesters wait on it
+type copyCall struct {
+	done chan struct{}
+	err  error
+}
+
+// copyCoordinator deduplicates image copies across all reconcile workers.
+// Given source->target pair is copied once: concurrent requesters wait for
+// the result of the copy in flight, and successful copies are remembered for ttl,
+// so the next workloads using the same image do not touch registries at all.
+type copyCoordinator struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	inflight map[copyKey]*copyCall
+	copied   map[copyKey]time.Time //successful copies -> expiration time
+	now      func() time.Time
+}
+
+// newCopyCoordinator creates coordinator, successful copies are cached for ttl
+// (zero ttl disables caching, but copies in flight are still deduplicated)
+func newCopyCoordinator(ttl time.Duration) *copyCoordinator {
+	return &copyCoordinator{
+		ttl:      ttl,
+		inflight: map[copyKey]*copyCall{},
+		copied:   map[copyKey]time.Time{},
+		now:      time.Now,
+	}
+}
+
+// run executes copy of src to dst via fn, unless the same copy is in flight
+// or has recently succeeded. Nil coordinator just calls fn.
+// NOTE! Copy in flight runs with the context of the first requester, so if it
+// is cancelled, all waiters get an error and are expected to retry.
+func (c *copyCoordinator) run(ctx context.Context, src, dst string, fn func(ctx context.Context) error) error {
+	if c == nil {
+		return fn(ctx)
+	}
+
+	key := copyKey{src: src, dst: dst}
+
+	c.mu.Lock()
+	if expires, cached := c.copied[key]; cached {
+		if c.now().Before(expires) {
+			c.mu.Unlock()
+			return nil
+		}
+		delete(c.copied, key)
+	}
+
+	if call, inFlight := c.inflight[key]; inFlight {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	call := &copyCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.err = fn(ctx)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil && c.ttl > 0 {
+		c.pruneLocked()
+		c.copied[key] = c.now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.err
+}
+
+// pruneLocked removes expired results. c.mu must be held
+func (c *copyCoordinator) pruneLocked() {
+	now := c.now()
+	for key, expires := range c.copied {
+		if !now.Before(expires) {
+			delete(c.copied, key)
+		}
+	}
+}
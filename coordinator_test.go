@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_copyCoordinator checks that concurrent copies of the same image
+// are executed once, successes are cached and failures are not
+func Test_copyCoordinator(t *testing.T) {
+	c := newCopyCoordinator(time.Minute)
+
+	var (
+		calls   int32
+		wg      sync.WaitGroup
+		release = make(chan struct{})
+		errs    = make(chan error, 10)
+	)
+	copyFn := func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.run(context.Background(), "redis:6", "backup/redis:6", copyFn)
+		}()
+	}
+	//let all requesters to join the copy in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	//cached
+	require.Nil(t, c.run(context.Background(), "redis:6", "backup/redis:6", copyFn))
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	//expired
+	c.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	require.Nil(t, c.run(context.Background(), "redis:6", "backup/redis:6", copyFn))
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	//failures are not cached
+	failFn := func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return fmt.Errorf("failed")
+	}
+	require.NotNil(t, c.run(context.Background(), "nginx", "backup/nginx", failFn))
+	require.NotNil(t, c.run(context.Background(), "nginx", "backup/nginx", failFn))
+	require.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
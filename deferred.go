@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// templateHashAnnotation holds hash of pod template of the workload, as seen by the controller.
+	// Deferred mode detects changes of pod template made by workload owner with it
+	templateHashAnnotation = "imgclonectrl.io/template-hash"
+)
+
+// templateHash returns hash of pod template of the object (pod spec for custom kinds)
+func templateHash(obj client.Object) (string, error) {
+	template, err := podTemplateOf(obj)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(template)
+	if err != nil {
+		return "", err
+	}
+	return shortHash(string(data)), nil
+}
+
+// reconcileDeferred processes object in deferred mode: images are backed up right away,
+// but the spec is rewritten only when pod template was changed by workload owner since
+// the controller has seen it last time, so the controller does not restart otherwise stable workloads.
+// NOTE! Rewrite is a second change of pod template, made after the owner's one: it starts
+// another rollout (new ReplicaSet), superseding the one of the owner's change
+func (r *reconciler) reconcileDeferred(ctx context.Context, ref workloadRef, obj client.Object) (reconcile.Result, error) {
+	lg := log.FromContext(ctx)
+
+	podSpec, err := podSpecOf(obj)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	hash, err := templateHash(obj)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	seenHash, seen := obj.GetAnnotations()[templateHashAnnotation]
+
+	imageSrcDst := r.imagesToBackup(podSpec)
+	if len(imageSrcDst) == 0 {
+		if err := r.patchConditions(ctx, obj,
+			condition(conditionImagesBackedUp, true, "BackedUp", "all images are in backup registry"),
+			condition(conditionSpecRewritten, true, "Rewritten", "workload uses images from backup registry"),
+			condition(conditionBackupFailed, false, "BackedUp", "")); err != nil {
+			lg.Error(err, "could not write status")
+		}
+		return r.watchRollout(ctx, ref, obj)
+	}
+
+	if err := r.pushImagesToBackupRegistry(ctx, imageSrcDst); err != nil {
+		err = fmt.Errorf("could not push images to remote registry: %w", err)
+		r.backupFailed(ctx, obj, err)
+		return r.retryLater(ctx, ref, obj, err), nil
+	}
+
+	if !seen || seenHash == hash {
+		//Wait for the owner to change the template, remembering it as seen now
+		base := obj.DeepCopyObject().(client.Object)
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[templateHashAnnotation] = hash
+		obj.SetAnnotations(annotations)
+		setConditions(obj,
+			condition(conditionImagesBackedUp, true, "BackedUp", "all images are in backup registry"),
+			condition(conditionSpecRewritten, false, "RewriteDeferred", "waiting for the next change of pod template"),
+			condition(conditionBackupFailed, false, "BackedUp", ""))
+		if !reflect.DeepEqual(base.GetAnnotations(), obj.GetAnnotations()) {
+			if err := r.client.Patch(ctx, obj, client.MergeFrom(base), client.FieldOwner(fieldManager)); err != nil {
+				lg.Error(err, "could not write status")
+			}
+		}
+		r.backoff.reset(ref)
+		return reconcile.Result{}, nil
+	}
+
+	//Rewrite starts a rollout of its own, so it's limited by the budget like other rewrites.
+	//Seen hash is kept, so the rewrite is retried once the budget allows
+	if wait, reason := r.rewriteBudget.take(ref.Namespace); wait > 0 {
+		lg.Info(fmt.Sprintf("rewrite deferred for %s: %s", wait.Round(time.Second), reason))
+		if err := r.patchConditions(ctx, obj,
+			condition(conditionImagesBackedUp, true, "BackedUp", "all images are in backup registry"),
+			condition(conditionSpecRewritten, false, "RewriteDeferred", reason),
+			condition(conditionBackupFailed, false, "BackedUp", "")); err != nil {
+			lg.Error(err, "could not write status")
+		}
+		r.backoff.reset(ref)
+		return reconcile.Result{RequeueAfter: wait}, nil
+	}
+
+	lg.Info("pod template was changed, rewriting right after the change")
+	err = r.patchImages(ctx, ref, obj, r.rewriteToBackups(imageSrcDst))
+	if err != nil {
+		r.rewriteBudget.refund(ref.Namespace)
+	}
+	if err == errImagesChanged { //reconciled again, since the object changed
+		lg.Info("images changed during backup")
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		return r.retryLater(ctx, ref, obj, fmt.Errorf("could not write %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, err)), nil
+	}
+
+	r.backoff.reset(ref)
+	if r.rolloutDeadline > 0 {
+		return reconcile.Result{RequeueAfter: r.rolloutCheckInterval}, nil
+	}
+	return reconcile.Result{}, nil
+}
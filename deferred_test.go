@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Test_reconcileDeferred checks images are backed up right away, but workload is rewritten
+// only along with the next change of pod template
+func Test_reconcileDeferred(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	srcRef, err := name.ParseReference(u.Host + "/library/nginx:1.19")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(srcRef, img))
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: srcRef.String()}}},
+			},
+		},
+	}
+	r := &reconciler{
+		client:              fake.NewClientBuilder().WithObjects(deployment).Build(),
+		backupRegistry:      u.Host + "/backup",
+		maxConcurrentCopies: 1,
+		rewriteMode:         rewriteModeDeferred,
+	}
+	ctx := context.Background()
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: "web"}}
+	key := types.NamespacedName{Namespace: "test", Name: "web"}
+	dstImage := r.getTargetImage(srcRef.String())
+	deployments := r.forKind(workloadKinds["Deployment"])
+
+	_, err = deployments.Reconcile(ctx, request)
+	require.NoError(t, err)
+
+	//backed up, but not rewritten
+	dstRef, err := name.ParseReference(dstImage)
+	require.NoError(t, err)
+	_, err = remote.Head(dstRef)
+	require.NoError(t, err)
+
+	current := &appsv1.Deployment{}
+	require.NoError(t, r.client.Get(ctx, key, current))
+	require.Equal(t, srcRef.String(), current.Spec.Template.Spec.Containers[0].Image)
+	rewritten := meta.FindStatusCondition(conditionsOf(current), conditionSpecRewritten)
+	require.NotNil(t, rewritten)
+	require.Equal(t, "RewriteDeferred", rewritten.Reason)
+
+	//reconciling again does not rewrite either
+	_, err = deployments.Reconcile(ctx, request)
+	require.NoError(t, err)
+	require.NoError(t, r.client.Get(ctx, key, current))
+	require.Equal(t, srcRef.String(), current.Spec.Template.Spec.Containers[0].Image)
+
+	//owner changes the template
+	current.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}}
+	require.NoError(t, r.client.Update(ctx, current))
+
+	//rewrite waits for the budget
+	r.rewriteBudget = newRewriteBudget(time.Hour, 1, 0, nil)
+	wait, _ := r.rewriteBudget.take("other")
+	require.Zero(t, wait)
+	result, err := deployments.Reconcile(ctx, request)
+	require.NoError(t, err)
+	require.True(t, result.RequeueAfter > 0)
+	require.NoError(t, r.client.Get(ctx, key, current))
+	require.Equal(t, srcRef.String(), current.Spec.Template.Spec.Containers[0].Image)
+	rewritten = meta.FindStatusCondition(conditionsOf(current), conditionSpecRewritten)
+	require.NotNil(t, rewritten)
+	require.Contains(t, rewritten.Message, "workloads rewritten within")
+
+	r.rewriteBudget.refund("other")
+	_, err = deployments.Reconcile(ctx, request)
+	require.NoError(t, err)
+	require.NoError(t, r.client.Get(ctx, key, current))
+	require.Equal(t, dstImage, current.Spec.Template.Spec.Containers[0].Image)
+	require.Equal(t, "debug", current.Spec.Template.Spec.Containers[0].Env[0].Value)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	crv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// maxResolvedDigests bounds the number of remembered index -> image digests
+const maxResolvedDigests = 10000
+
+// cachedDigest is a digest of the image reference with expiration time
+type cachedDigest struct {
+	digest  crv1.Hash
+	expires time.Time
+}
+
+// digestCache remembers digests of source images, so steady state reconciles
+// do not spend registry rate limits on checking images that were just checked.
+//
+// Digests of references (tags) are mutable and cached for ttl only.
+// For multi-platform images, digest of an index is resolved to the digest of the
+// image that is actually copied. This mapping is content addressed, thus immutable.
+type digestCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	refs     map[string]cachedDigest //reference -> digest of image to copy
+	resolved map[crv1.Hash]crv1.Hash //index digest -> image digest
+	now      func() time.Time
+}
+
+// newDigestCache creates cache, reference digests are kept for ttl
+func newDigestCache(ttl time.Duration) *digestCache {
+	return &digestCache{
+		ttl:      ttl,
+		refs:     map[string]cachedDigest{},
+		resolved: map[crv1.Hash]crv1.Hash{},
+		now:      time.Now,
+	}
+}
+
+// get returns cached digest of reference. Nil cache always misses
+func (c *digestCache) get(ref string) (crv1.Hash, bool) {
+	if c == nil {
+		return crv1.Hash{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, exists := c.refs[ref]
+	if !exists {
+		return crv1.Hash{}, false
+	}
+	if !c.now().Before(cached.expires) {
+		delete(c.refs, ref)
+		return crv1.Hash{}, false
+	}
+	return cached.digest, true
+}
+
+// put caches digest of the reference
+func (c *digestCache) put(ref string, digest crv1.Hash) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for key, cached := range c.refs {
+		if !now.Before(cached.expires) {
+			delete(c.refs, key)
+		}
+	}
+	c.refs[ref] = cachedDigest{digest: digest, expires: now.Add(c.ttl)}
+}
+
+// getResolved returns image digest, the index digest resolves to
+func (c *digestCache) getResolved(index crv1.Hash) (crv1.Hash, bool) {
+	if c == nil {
+		return crv1.Hash{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	digest, exists := c.resolved[index]
+	return digest, exists
+}
+
+// putResolved remembers image digest, the index digest resolves to
+func (c *digestCache) putResolved(index, digest crv1.Hash) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.resolved) >= maxResolvedDigests {
+		c.resolved = map[crv1.Hash]crv1.Hash{}
+	}
+	c.resolved[index] = digest
+}
+
+// sourceDigest returns digest of the image that would be copied from srcRef.
+// Cached digest is used if possible, otherwise HEAD request is issued, which
+// is not counted against Docker Hub pull rate limit. Manifest is fetched only
+// if registry does not support HEAD or srcRef points to not yet resolved index.
+func (r *reconciler) sourceDigest(srcRef name.Reference, opts ...remote.Option) (crv1.Hash, error) {
+	registry := srcRef.Context().RegistryStr()
+
+	if digest, cached := r.digests.get(srcRef.String()); cached {
+		manifestRequestsAvoided.WithLabelValues(registry, "cache").Inc()
+		return digest, nil
+	}
+
+	desc, err := remote.Head(srcRef, opts...)
+	if isNotFound(err) {
+		return crv1.Hash{}, err
+	}
+	if err == nil && !desc.MediaType.IsIndex() {
+		manifestRequestsAvoided.WithLabelValues(registry, "head").Inc()
+		r.digests.put(srcRef.String(), desc.Digest)
+		return desc.Digest, nil
+	}
+	if err == nil {
+		if digest, resolved := r.digests.getResolved(desc.Digest); resolved {
+			manifestRequestsAvoided.WithLabelValues(registry, "head").Inc()
+			r.digests.put(srcRef.String(), digest)
+			return digest, nil
+		}
+	}
+
+	//Either HEAD is not supported, or index has to be resolved to the image
+	manifestRequests.WithLabelValues(registry).Inc()
+	img, err := remote.Image(srcRef, opts...)
+	if err != nil {
+		return crv1.Hash{}, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return crv1.Hash{}, err
+	}
+
+	if desc != nil && desc.MediaType.IsIndex() {
+		r.digests.putResolved(desc.Digest, digest)
+	}
+	r.digests.put(srcRef.String(), digest)
+	return digest, nil
+}
+
+// targetDigest returns digest of the image in backup registry. HEAD request is
+// used, with fallback to fetching manifest for registries not supporting HEAD.
+func targetDigest(dstRef name.Reference, opts ...remote.Option) (crv1.Hash, error) {
+	desc, err := remote.Head(dstRef, opts...)
+	if err == nil {
+		return desc.Digest, nil
+	}
+	if isNotFound(err) {
+		return crv1.Hash{}, err
+	}
+
+	manifestRequests.WithLabelValues(dstRef.Context().RegistryStr()).Inc()
+	img, err := remote.Image(dstRef, opts...)
+	if err != nil {
+		return crv1.Hash{}, err
+	}
+	return img.Digest()
+}
+
+// isNotFound reports whether registry responded with 404
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
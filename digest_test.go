@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	crv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/require"
+)
+
+// Test_digestCache checks digests of references expire after ttl
+func Test_digestCache(t *testing.T) {
+	now := time.Now()
+	c := newDigestCache(time.Minute)
+	c.now = func() time.Time { return now }
+	digest := crv1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+
+	_, cached := c.get("nginx:1.19")
+	require.False(t, cached)
+
+	c.put("nginx:1.19", digest)
+	got, cached := c.get("nginx:1.19")
+	require.True(t, cached)
+	require.Equal(t, digest, got)
+
+	now = now.Add(time.Minute)
+	_, cached = c.get("nginx:1.19")
+	require.False(t, cached, "expired")
+
+	//zero ttl and nil cache do not cache
+	noCache := newDigestCache(0)
+	noCache.put("nginx:1.19", digest)
+	_, cached = noCache.get("nginx:1.19")
+	require.False(t, cached)
+	var nilCache *digestCache
+	nilCache.put("nginx:1.19", digest)
+	_, cached = nilCache.get("nginx:1.19")
+	require.False(t, cached)
+}
+
+// Test_sourceDigest checks digests are got with HEAD requests and cached, and index
+// is resolved to the digest of the image for the platform once
+func Test_sourceDigest(t *testing.T) {
+	var manifestGets int32
+	handler := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/manifests/") {
+			atomic.AddInt32(&manifestGets, 1)
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+	imgRef, err := name.ParseReference(u.Host + "/library/nginx:1.19")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(imgRef, img))
+
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: crv1.Descriptor{Platform: &crv1.Platform{OS: "linux", Architecture: "amd64"}},
+	})
+	indexRef, err := name.ParseReference(u.Host + "/library/redis:6")
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(indexRef, index))
+
+	now := time.Now()
+	r := &reconciler{digests: newDigestCache(time.Minute)}
+	r.digests.now = func() time.Time { return now }
+
+	//image digest is got with HEAD
+	digest, err := r.sourceDigest(imgRef)
+	require.NoError(t, err)
+	require.Equal(t, imgDigest, digest)
+	require.Equal(t, int32(0), atomic.LoadInt32(&manifestGets))
+
+	//index is resolved to the image with GET
+	digest, err = r.sourceDigest(indexRef)
+	require.NoError(t, err)
+	require.Equal(t, imgDigest, digest)
+	gets := atomic.LoadInt32(&manifestGets)
+	require.True(t, gets > 0)
+
+	//cached digest of reference, then cached resolution of index after ttl
+	digest, err = r.sourceDigest(indexRef)
+	require.NoError(t, err)
+	require.Equal(t, imgDigest, digest)
+	now = now.Add(2 * time.Minute)
+	digest, err = r.sourceDigest(indexRef)
+	require.NoError(t, err)
+	require.Equal(t, imgDigest, digest)
+	require.Equal(t, gets, atomic.LoadInt32(&manifestGets))
+
+	missingRef, err := name.ParseReference(u.Host + "/library/missing:1.0")
+	require.NoError(t, err)
+	_, err = r.sourceDigest(missingRef)
+	require.True(t, isNotFound(err))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	// regexPrefix marks pattern as regular expression, otherwise pattern is a glob
+	regexPrefix = "regex:"
+	// dockerHubAlias is the name Docker Hub is usually referred as, while
+	// parsed references name it as name.DefaultRegistry (index.docker.io)
+	dockerHubAlias = "docker.io"
+)
+
+// imagePattern matches image references or registries, either as glob
+// (see matchGlob, i.e. `docker.io/library/*`) or as regular expression
+// (prefixed with `regex:`, matched against the whole value)
+type imagePattern struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+// matchGlob matches value against glob pattern (see path.Match), where `*` matches within
+// a single path segment, while `**` matches any sequence, including `/` (i.e. `docker.io/bitnami/**`)
+func matchGlob(pattern, value string) bool {
+	i := strings.Index(pattern, "**")
+	if i < 0 {
+		matched, _ := path.Match(pattern, value)
+		return matched
+	}
+	prefix, rest := pattern[:i], strings.TrimLeft(pattern[i:], "*")
+	for start := 0; start <= len(value); start++ {
+		if matched, _ := path.Match(prefix, value[:start]); !matched {
+			continue
+		}
+		for end := start; end <= len(value); end++ {
+			if matchGlob(rest, value[end:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseImagePattern parses glob or `regex:` prefixed regular expression
+func parseImagePattern(value string) (imagePattern, error) {
+	if strings.HasPrefix(value, regexPrefix) {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(value, regexPrefix) + ")$")
+		if err != nil {
+			return imagePattern{}, fmt.Errorf("invalid regular expression %q: %w", value, err)
+		}
+		return imagePattern{regex: re}, nil
+	}
+	if _, err := path.Match(value, ""); err != nil {
+		return imagePattern{}, fmt.Errorf("invalid glob %q: %w", value, err)
+	}
+	return imagePattern{glob: value}, nil
+}
+
+// matches checks if any of the values matches the pattern
+func (p imagePattern) matches(values ...string) bool {
+	for _, value := range values {
+		if p.regex != nil && p.regex.MatchString(value) {
+			return true
+		}
+		if p.regex == nil {
+			if matchGlob(p.glob, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// imageFilter selects images to be backed up. Image is backed up, if it matches any of
+// include patterns (or there are no include patterns at all) and none of exclude patterns.
+// Image patterns are matched against image as written in the spec and its fully qualified
+// reference (i.e. `nginx` and `index.docker.io/library/nginx:latest`), registry patterns
+// against registry of the image. Docker Hub is matched both as `docker.io` and `index.docker.io`
+type imageFilter struct {
+	includeImages, excludeImages         []imagePattern
+	includeRegistries, excludeRegistries []imagePattern
+}
+
+// newImageFilter parses patterns of the filter
+func newImageFilter(includeImages, excludeImages, includeRegistries, excludeRegistries flagSet) (*imageFilter, error) {
+	f := &imageFilter{}
+	for _, list := range []struct {
+		values   flagSet
+		patterns *[]imagePattern
+	}{
+		{includeImages, &f.includeImages},
+		{excludeImages, &f.excludeImages},
+		{includeRegistries, &f.includeRegistries},
+		{excludeRegistries, &f.excludeRegistries},
+	} {
+		for value := range list.values {
+			p, err := parseImagePattern(value)
+			if err != nil {
+				return nil, err
+			}
+			*list.patterns = append(*list.patterns, p)
+		}
+	}
+	return f, nil
+}
+
+// matchesAny checks if any of the patterns matches any of the values
+func matchesAny(patterns []imagePattern, values ...string) bool {
+	for _, p := range patterns {
+		if p.matches(values...) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows checks if the image is to be backed up. Nil filter allows every image
+func (f *imageFilter) allows(image string) bool {
+	if f == nil {
+		return true
+	}
+
+	images := []string{image}
+	var registries []string
+	if ref, err := name.ParseReference(image); err == nil {
+		images = append(images, ref.Name())
+		registries = append(registries, ref.Context().RegistryStr())
+		if ref.Context().RegistryStr() == name.DefaultRegistry {
+			images = append(images, dockerHubAlias+strings.TrimPrefix(ref.Name(), name.DefaultRegistry))
+			registries = append(registries, dockerHubAlias)
+		}
+	}
+
+	if len(f.includeImages) != 0 || len(f.includeRegistries) != 0 {
+		if !matchesAny(f.includeImages, images...) && !matchesAny(f.includeRegistries, registries...) {
+			return false
+		}
+	}
+	return !matchesAny(f.excludeImages, images...) && !matchesAny(f.excludeRegistries, registries...)
+}
+
+// isBackupImage checks if the image is in the backup repository (or backup repository of any
+// namespace), by comparing parsed references, so images of other repositories sharing the prefix
+// (i.e. `backup-tools`) are not mistaken for backups
+func (r *reconciler) isBackupImage(image string) bool {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return false
+	}
+	if _, known := r.registries.authOf(ref.Context()); known {
+		return true
+	}
+	repo, err := name.NewRepository(r.backupRegistry)
+	if err != nil {
+		return false
+	}
+	return ref.Context().Name() == repo.Name()
+}
+
+// shouldBackup checks if the image is to be backed up: it's not a backup already and it passes image filter
+func (r *reconciler) shouldBackup(image string) bool {
+	return !r.isBackupImage(image) && r.imageFilter.allows(image)
+}
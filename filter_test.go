@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_imageFilter(t *testing.T) {
+	f, err := newImageFilter(
+		flagSet{},
+		flagSet{"regex:.*:.*-debug": {}, "docker.io/library/busybox*": {}},
+		flagSet{},
+		flagSet{"*.dkr.ecr.*.amazonaws.com": {}, "artifactory.example.com": {}},
+	)
+	require.NoError(t, err)
+
+	require.True(t, f.allows("nginx:1.19"))
+	require.True(t, f.allows("quay.io/prometheus/node-exporter:v1.1.2"))
+	require.False(t, f.allows("123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:1.0"))
+	require.False(t, f.allows("artifactory.example.com/team/app:1.0"))
+	require.False(t, f.allows("quay.io/app:1.0-debug"))
+	require.False(t, f.allows("busybox:1.33"), "fully qualified reference is matched")
+
+	//only included registries are backed up
+	f, err = newImageFilter(flagSet{}, flagSet{}, flagSet{"docker.io": {}, "regex:(.+\\.)?gcr\\.io": {}}, flagSet{})
+	require.NoError(t, err)
+	require.True(t, f.allows("nginx:1.19"))
+	require.True(t, f.allows("eu.gcr.io/project/app:1.0"))
+	require.False(t, f.allows("quay.io/app:1.0"))
+
+	//nested paths are matched with **
+	f, err = newImageFilter(flagSet{}, flagSet{"ghcr.io/org/*": {}, "quay.io/team/**": {}}, flagSet{}, flagSet{})
+	require.NoError(t, err)
+	require.False(t, f.allows("ghcr.io/org/app:1.0"))
+	require.True(t, f.allows("ghcr.io/org/group/app:1.0"), "* does not cross /")
+	require.False(t, f.allows("quay.io/team/app:1.0"))
+	require.False(t, f.allows("quay.io/team/group/sub/app:1.0"))
+	require.True(t, f.allows("quay.io/other/app:1.0"))
+	require.True(t, matchGlob("docker.io/**/app:*", "docker.io/a/b/app:1.0"))
+	require.False(t, matchGlob("docker.io/**/app:*", "docker.io/a/b/app/x:1.0"))
+
+	_, err = newImageFilter(flagSet{"regex:(": {}}, flagSet{}, flagSet{}, flagSet{})
+	require.Error(t, err)
+	_, err = newImageFilter(flagSet{"[": {}}, flagSet{}, flagSet{}, flagSet{})
+	require.Error(t, err)
+
+	var nilFilter *imageFilter
+	require.True(t, nilFilter.allows("nginx:1.19"))
+}
+
+// Test_isBackupImage checks only images of the backup repository are taken for backups
+func Test_isBackupImage(t *testing.T) {
+	r := &reconciler{backupRegistry: "registry.example.com/backup"}
+
+	require.True(t, r.isBackupImage(r.getTargetImage("nginx:1.19")))
+	require.True(t, r.isBackupImage("registry.example.com/backup:nginx_1.19_sha256-aaa"))
+	require.False(t, r.isBackupImage("registry.example.com/backup-tools:1.0"))
+	require.False(t, r.isBackupImage("registry.example.com/backup/nginx:1.19"))
+	require.False(t, r.isBackupImage("nginx:1.19"))
+
+	r.imageFilter, _ = newImageFilter(flagSet{}, flagSet{"registry.example.com/*": {}}, flagSet{}, flagSet{})
+	require.False(t, r.shouldBackup("registry.example.com/backup-tools:1.0"))
+	require.True(t, r.shouldBackup("nginx:1.19"))
+}
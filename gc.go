@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// backupGC deletes backup images not referenced by any workload for retention period.
+// Registries delete images by digest (removing all the tags pointing to it), so image
+// is deleted only if none of its tags is referenced, protected or within retention.
+// Digest suffixed tags, kept by tag mutation policies (see historyTag), are kept as long as
+// their backup tags are referenced, then they expire like other tags.
+// NOTE! Retention is counted from the moment GC first sees tag unreferenced, and
+// restarts with the controller. Only default backup registry is collected, backup
+// registries of namespaces (see forNamespace) are left to their owners.
+type backupGC struct {
+	r         *reconciler
+	retention time.Duration
+	dryRun    bool
+	protected []string //glob patterns of protected tags
+
+	mu    sync.Mutex
+	since map[string]time.Time //tag -> first seen unreferenced
+	now   func() time.Time
+}
+
+func newBackupGC(r *reconciler, retention time.Duration, dryRun bool, protected []string) *backupGC {
+	return &backupGC{
+		r:         r,
+		retention: retention,
+		dryRun:    dryRun,
+		protected: protected,
+		since:     map[string]time.Time{},
+		now:       time.Now,
+	}
+}
+
+// isProtected checks tag against protected patterns
+func (gc *backupGC) isProtected(tag string) bool {
+	for _, pattern := range gc.protected {
+		if matched, _ := path.Match(pattern, tag); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// selectGarbage returns digests of images to delete, given tags of backup repository
+// (tag -> digest). It also updates the time tags are unreferenced since
+func (gc *backupGC) selectGarbage(tags map[string]string, referenced map[string]struct{}) []string {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	now := gc.now()
+	keep := map[string]struct{}{}    //digests to keep
+	expired := map[string]struct{}{} //digests of expired tags
+
+	for tag := range gc.since { //tags deleted meanwhile
+		if _, exists := tags[tag]; !exists {
+			delete(gc.since, tag)
+		}
+	}
+
+	for tag, digest := range tags {
+		_, used := referenced[tag]
+		if base, isHistory := historyBase(tag, digest); isHistory && !used {
+			_, used = referenced[base]
+		}
+		if used {
+			delete(gc.since, tag)
+			keep[digest] = struct{}{}
+			continue
+		}
+		if gc.isProtected(tag) {
+			keep[digest] = struct{}{}
+			continue
+		}
+
+		since, seen := gc.since[tag]
+		if !seen {
+			gc.since[tag] = now
+			since = now
+		}
+		if now.Sub(since) < gc.retention {
+			keep[digest] = struct{}{}
+			continue
+		}
+		expired[digest] = struct{}{}
+	}
+
+	garbage := make([]string, 0, len(expired))
+	for digest := range expired {
+		if _, kept := keep[digest]; !kept {
+			garbage = append(garbage, digest)
+		}
+	}
+	sort.Strings(garbage)
+	return garbage
+}
+
+// run is a single GC pass over the backup repository
+func (gc *backupGC) run(ctx context.Context) {
+	lg := log.FromContext(ctx)
+
+	repo, err := name.NewRepository(gc.r.backupRegistry)
+	if err != nil {
+		lg.Error(err, "could not parse backup registry")
+		return
+	}
+	opts := []remote.Option{gc.r.backupAuth(), remote.WithContext(ctx)}
+
+	tagList, err := remote.ListWithContext(ctx, repo, gc.r.backupAuth())
+	if err != nil {
+		lg.Error(err, "could not list backup images")
+		return
+	}
+
+	tags := make(map[string]string, len(tagList)) //tag -> digest
+	tagsOf := map[string][]string{}               //digest -> tags
+	for _, tag := range tagList {
+		digest, err := targetDigest(repo.Tag(tag), opts...)
+		if err != nil {
+			lg.Error(err, fmt.Sprintf("could not get digest of %q, skipping collection", tag))
+			return
+		}
+		tags[tag] = digest.String()
+		tagsOf[digest.String()] = append(tagsOf[digest.String()], tag)
+	}
+
+	referenced := map[string]struct{}{}
+	for target := range gc.r.inventory.referencedTargets() {
+		if ref, err := name.NewTag(target); err == nil && ref.Context().String() == repo.String() {
+			referenced[ref.TagStr()] = struct{}{}
+		}
+	}
+
+	garbage := gc.selectGarbage(tags, referenced)
+	gcCandidates.Set(float64(len(garbage)))
+
+	for _, digest := range garbage {
+		if gc.dryRun {
+			lg.Info(fmt.Sprintf("dry run: would delete %s@%s", repo.String(), digest), "tags", tagsOf[digest])
+			continue
+		}
+
+		lg.Info(fmt.Sprintf("deleting %s@%s", repo.String(), digest), "tags", tagsOf[digest])
+		if err := remote.Delete(repo.Digest(digest), opts...); err != nil {
+			lg.Error(err, fmt.Sprintf("could not delete %s@%s", repo.String(), digest))
+			continue
+		}
+		gcDeleted.Inc()
+		for _, tag := range tagsOf[digest] {
+			gc.r.inventory.forgetTarget(repo.Tag(tag).String())
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_selectGarbage checks selection of backup images to delete
+func Test_selectGarbage(t *testing.T) {
+	now := time.Now()
+	gc := newBackupGC(nil, time.Hour, false, []string{"library_postgres_*"})
+	gc.now = func() time.Time { return now }
+
+	tags := map[string]string{
+		"library_nginx_1.19":              "sha256:nginx",
+		"library_nginx_1.19_0123456789ab": "sha256:nginx-old",
+		"library_redis_6":                 "sha256:redis",
+		"library_redis_latest":            "sha256:redis", //same image as referenced tag
+		"library_postgres_13":             "sha256:postgres",
+	}
+	referenced := map[string]struct{}{"library_nginx_1.19": {}, "library_redis_6": {}}
+
+	//retention starts when tag is first seen unreferenced
+	require.Empty(t, gc.selectGarbage(tags, referenced))
+
+	now = now.Add(2 * time.Hour)
+	require.Equal(t, []string{"sha256:nginx-old"}, gc.selectGarbage(tags, referenced))
+
+	//redis_6 is not referenced anymore, retention starts over for it
+	delete(referenced, "library_redis_6")
+	require.Equal(t, []string{"sha256:nginx-old"}, gc.selectGarbage(tags, referenced))
+
+	now = now.Add(2 * time.Hour)
+	require.Equal(t, []string{"sha256:nginx-old", "sha256:redis"}, gc.selectGarbage(tags, referenced))
+}
+
+// Test_selectGarbageHistory checks digest suffixed tags of images they point to are kept while
+// their backup tags are referenced, and are collected after retention otherwise
+func Test_selectGarbageHistory(t *testing.T) {
+	now := time.Now()
+	gc := newBackupGC(nil, time.Hour, false, nil)
+	gc.now = func() time.Time { return now }
+
+	previous := "sha256:" + strings.Repeat("a", 64)
+	current := "sha256:" + strings.Repeat("b", 64)
+	tags := map[string]string{
+		"library_nginx_1.19":              current,
+		"library_nginx_1.19_aaaaaaaaaaaa": previous,
+		"library_redis_6_dddddddddddd":    "sha256:" + strings.Repeat("d", 64), //redis_6 is not referenced
+		"library_redis_6_cccccccccccc":    previous,                            //suffix of different digest
+	}
+	referenced := map[string]struct{}{"library_nginx_1.19": {}}
+
+	require.Empty(t, gc.selectGarbage(tags, referenced))
+	now = now.Add(2 * time.Hour)
+	require.Equal(t, []string{"sha256:" + strings.Repeat("d", 64)}, gc.selectGarbage(tags, referenced))
+
+	//backup tag is not referenced anymore, its history expires with it
+	delete(referenced, "library_nginx_1.19")
+	require.Equal(t, []string{"sha256:" + strings.Repeat("d", 64)}, gc.selectGarbage(tags, referenced))
+	now = now.Add(2 * time.Hour)
+	require.Equal(t, []string{previous, current, "sha256:" + strings.Repeat("d", 64)}, gc.selectGarbage(tags, referenced))
+
+	base, isHistory := historyBase("library_nginx_1.19_aaaaaaaaaaaa", previous)
+	require.True(t, isHistory)
+	require.Equal(t, "library_nginx_1.19", base)
+	_, isHistory = historyBase("library_nginx_1.19_aaaaaaaaaaaa", "sha256:nginx")
+	require.False(t, isHistory)
+}
@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/google/go-containerregistry v0.4.1
+	github.com/prometheus/client_golang v1.7.1
 	github.com/stretchr/testify v1.6.1
 	k8s.io/api v0.20.2
 	k8s.io/apimachinery v0.20.2
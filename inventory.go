@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	// upstreamAvailable - upstream image is available with the digest that was backed up
+	upstreamAvailable = "Available"
+	// upstreamDeleted - upstream image (tag or digest) does not exist anymore
+	upstreamDeleted = "Deleted"
+	// upstreamMoved - upstream tag points to a digest different from the backed up one
+	upstreamMoved = "Moved"
+)
+
+// workloadRef identifies workload using backup image
+type workloadRef struct {
+	Kind, Namespace, Name string
+}
+
+// String returns workload reference as Kind/namespace/name
+func (w workloadRef) String() string {
+	return fmt.Sprintf("%s/%s/%s", w.Kind, w.Namespace, w.Name)
+}
+
+// parseWorkloadRef parses Kind/namespace/name
+func parseWorkloadRef(value string) (workloadRef, error) {
+	parts := strings.SplitN(value, "/", 3)
+	if len(parts) != 3 {
+		return workloadRef{}, fmt.Errorf("could not parse workload reference %q", value)
+	}
+	return workloadRef{Kind: parts[0], Namespace: parts[1], Name: parts[2]}, nil
+}
+
+// backupRecord describes backup of single source image
+type backupRecord struct {
+	Source, Target string
+	Digest         string                   //digest of the backed up image
+	Size           int64                    //compressed size of the backed up image
+	Platforms      []string                 //platforms of the backed up image, as os/arch
+	BackedUp       time.Time                //when backup was made (or found up to date)
+	LastVerified   time.Time                //when backup was verified to be in backup registry
+	Workloads      map[workloadRef]struct{} //workloads using the image
+
+	UpstreamState  string    //upstream state, as seen by the last check
+	UpstreamDigest string    //digest of upstream image, as seen by the last check
+	UpstreamSince  time.Time //when upstream came to UpstreamState
+}
+
+// workloadNames returns sorted list of workloads using the image
+func (b *backupRecord) workloadNames() []string {
+	names := make([]string, 0, len(b.Workloads))
+	for w := range b.Workloads {
+		names = append(names, w.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// namespaces returns sorted list of namespaces of workloads using the image
+func (b *backupRecord) namespaces() []string {
+	seen := map[string]struct{}{}
+	namespaces := []string{}
+	for w := range b.Workloads {
+		if _, isSeen := seen[w.Namespace]; !isSeen {
+			seen[w.Namespace] = struct{}{}
+			namespaces = append(namespaces, w.Namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// copyRecord returns deep copy of the record
+func (b *backupRecord) copyRecord() backupRecord {
+	c := *b
+	c.Platforms = append([]string(nil), b.Platforms...)
+	c.Workloads = make(map[workloadRef]struct{}, len(b.Workloads))
+	for w := range b.Workloads {
+		c.Workloads[w] = struct{}{}
+	}
+	return c
+}
+
+// inventory keeps track of backed up images and workloads using them.
+// Changes are tracked, so they can be persisted (see inventoryStore)
+type inventory struct {
+	mu        sync.Mutex
+	records   map[copyKey]*backupRecord
+	workloads map[workloadRef]map[copyKey]struct{} //workload -> images it uses
+	dirty     map[copyKey]struct{}                 //changed records
+	removed   map[copyKey]struct{}                 //removed records
+	now       func() time.Time
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		records:   map[copyKey]*backupRecord{},
+		workloads: map[workloadRef]map[copyKey]struct{}{},
+		dirty:     map[copyKey]struct{}{},
+		removed:   map[copyKey]struct{}{},
+		now:       time.Now,
+	}
+}
+
+// recordLocked returns record of src -> dst, creating it if needed. i.mu must be held
+func (i *inventory) recordLocked(key copyKey) *backupRecord {
+	record, exists := i.records[key]
+	if !exists {
+		record = &backupRecord{Source: key.src, Target: key.dst, Workloads: map[workloadRef]struct{}{}}
+		i.records[key] = record
+		delete(i.removed, key)
+	}
+	i.dirty[key] = struct{}{}
+	return record
+}
+
+// recordBackup registers backup of src image as dst with the digest. Nil inventory does nothing
+func (i *inventory) recordBackup(src, dst, digest string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	record := i.recordLocked(copyKey{src: src, dst: dst})
+	//backup is taken from upstream, so it's available
+	if record.UpstreamState != upstreamAvailable || record.UpstreamDigest != digest {
+		record.UpstreamState, record.UpstreamDigest, record.UpstreamSince = upstreamAvailable, digest, i.now()
+	}
+	record.Digest = digest
+	record.BackedUp = i.now()
+	record.LastVerified = record.BackedUp
+}
+
+// recordDetails registers size and platforms of backup image
+func (i *inventory) recordDetails(src, dst string, size int64, platforms []string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	record := i.recordLocked(copyKey{src: src, dst: dst})
+	record.Size = size
+	record.Platforms = platforms
+}
+
+// setDigest sets digest of backup image, found in backup registry
+// (i.e. for images backed up before controller restart)
+func (i *inventory) setDigest(src, dst, digest string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	key := copyKey{src: src, dst: dst}
+	if record, exists := i.records[key]; exists {
+		record.Digest = digest
+		i.dirty[key] = struct{}{}
+	}
+}
+
+// markVerified records that backup was verified to be intact in backup registry
+func (i *inventory) markVerified(src, dst string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	key := copyKey{src: src, dst: dst}
+	if record, exists := i.records[key]; exists {
+		record.LastVerified = i.now()
+		i.dirty[key] = struct{}{}
+	}
+}
+
+// setReferences registers images (src -> dst) the workload uses, replacing previously registered ones
+func (i *inventory) setReferences(workload workloadRef, imageSrcDst map[string]string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	keys := make(map[copyKey]struct{}, len(imageSrcDst))
+	for src, dst := range imageSrcDst {
+		keys[copyKey{src: src, dst: dst}] = struct{}{}
+	}
+	if sameKeys(keys, i.workloads[workload]) {
+		return
+	}
+
+	i.forgetWorkloadLocked(workload)
+	if len(keys) == 0 {
+		return
+	}
+	for key := range keys {
+		i.recordLocked(key).Workloads[workload] = struct{}{}
+	}
+	i.workloads[workload] = keys
+}
+
+// sameKeys compares sets of keys
+func sameKeys(a, b map[copyKey]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, exists := b[key]; !exists {
+			return false
+		}
+	}
+	return true
+}
+
+// forgetWorkload removes references of deleted workload
+func (i *inventory) forgetWorkload(workload workloadRef) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.forgetWorkloadLocked(workload)
+}
+
+func (i *inventory) forgetWorkloadLocked(workload workloadRef) {
+	for key := range i.workloads[workload] {
+		if record, exists := i.records[key]; exists {
+			delete(record.Workloads, workload)
+			i.dirty[key] = struct{}{}
+		}
+	}
+	delete(i.workloads, workload)
+}
+
+// setUpstream records state of upstream image, as seen by the check.
+// Returns true, if the state changed
+func (i *inventory) setUpstream(src, dst, state, digest string) bool {
+	if i == nil {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	key := copyKey{src: src, dst: dst}
+	record, exists := i.records[key]
+	if !exists {
+		return false
+	}
+
+	changed := record.UpstreamState != state || record.UpstreamDigest != digest
+	if changed {
+		record.UpstreamState, record.UpstreamDigest, record.UpstreamSince = state, digest, i.now()
+		i.dirty[key] = struct{}{}
+	}
+	return changed
+}
+
+// movedUpstream returns new digests of upstream images (src -> digest), tags of which were moved
+// after they were backed up, so their backups hold the previous images. Nil inventory knows none
+func (i *inventory) movedUpstream(imageSrcDst map[string]string) map[string]string {
+	moved := map[string]string{}
+	if i == nil {
+		return moved
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for src, dst := range imageSrcDst {
+		if record, exists := i.records[copyKey{src: src, dst: dst}]; exists && record.UpstreamState == upstreamMoved {
+			moved[src] = record.UpstreamDigest
+		}
+	}
+	return moved
+}
+
+// backups returns copies of all records of backup images. Note that digest is not known
+// for images referenced by workloads, but not copied since controller start
+func (i *inventory) backups() []backupRecord {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	records := make([]backupRecord, 0, len(i.records))
+	for _, record := range i.records {
+		records = append(records, record.copyRecord())
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Source < records[b].Source })
+	return records
+}
+
+// isBackedUp checks if the source image was backed up as the target image
+func (i *inventory) isBackedUp(src, dst string) bool {
+	if i == nil {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for key, record := range i.records {
+		if record.Digest != "" && sameReference(key.src, src) && sameReference(key.dst, dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedTargets returns backup images referenced by workloads
+func (i *inventory) referencedTargets() map[string]struct{} {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	targets := map[string]struct{}{}
+	for key, record := range i.records {
+		if len(record.Workloads) != 0 {
+			targets[key.dst] = struct{}{}
+		}
+	}
+	return targets
+}
+
+// forgetTarget removes unreferenced records of the (deleted) backup image
+func (i *inventory) forgetTarget(target string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for key, record := range i.records {
+		if len(record.Workloads) == 0 && sameReference(key.dst, target) {
+			delete(i.records, key)
+			delete(i.dirty, key)
+			i.removed[key] = struct{}{}
+		}
+	}
+}
+
+// sameReference compares image references in their canonical form
+func sameReference(a, b string) bool {
+	refA, errA := name.ParseReference(a)
+	refB, errB := name.ParseReference(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return refA.Name() == refB.Name()
+}
+
+// load adds records (i.e. persisted before controller restart) to inventory.
+// Records already known (i.e. registered by workloads reconciled meanwhile) get
+// persisted details, unless they know newer ones. Workloads are not loaded, since
+// they are registered again, as workloads are reconciled
+func (i *inventory) load(records []backupRecord) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, loaded := range records {
+		key := copyKey{src: loaded.Source, dst: loaded.Target}
+		record, exists := i.records[key]
+		if !exists {
+			loadedRecord := loaded.copyRecord()
+			loadedRecord.Workloads = map[workloadRef]struct{}{}
+			i.records[key] = &loadedRecord
+			continue
+		}
+
+		if loaded.BackedUp.After(record.BackedUp) {
+			record.Digest, record.Size, record.BackedUp = loaded.Digest, loaded.Size, loaded.BackedUp
+			record.Platforms = append([]string(nil), loaded.Platforms...)
+		}
+		if loaded.LastVerified.After(record.LastVerified) {
+			record.LastVerified = loaded.LastVerified
+		}
+		if record.UpstreamState == "" || loaded.UpstreamSince.After(record.UpstreamSince) {
+			record.UpstreamState, record.UpstreamDigest, record.UpstreamSince = loaded.UpstreamState, loaded.UpstreamDigest, loaded.UpstreamSince
+		}
+	}
+}
+
+// takeChanges returns changed records and keys of removed ones, since the previous call
+func (i *inventory) takeChanges() ([]backupRecord, []copyKey) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	changed := make([]backupRecord, 0, len(i.dirty))
+	for key := range i.dirty {
+		if record, exists := i.records[key]; exists {
+			changed = append(changed, record.copyRecord())
+		}
+	}
+	removed := make([]copyKey, 0, len(i.removed))
+	for key := range i.removed {
+		removed = append(removed, key)
+	}
+
+	i.dirty = map[copyKey]struct{}{}
+	i.removed = map[copyKey]struct{}{}
+	return changed, removed
+}
+
+// markDirty marks records as changed again (i.e. when they could not be persisted)
+func (i *inventory) markDirty(keys []copyKey) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, key := range keys {
+		if _, exists := i.records[key]; exists {
+			i.dirty[key] = struct{}{}
+		} else {
+			i.removed[key] = struct{}{}
+		}
+	}
+}
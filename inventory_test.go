@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_inventory checks tracking of workloads referencing backup images
+func Test_inventory(t *testing.T) {
+	inv := newInventory()
+	web := workloadRef{Kind: "Deployment", Namespace: "test", Name: "web"}
+	agent := workloadRef{Kind: "DaemonSet", Namespace: "test", Name: "agent"}
+
+	inv.setReferences(web, map[string]string{"nginx:1.19": "backup:nginx_1.19", "redis:6": "backup:redis_6"})
+	inv.setReferences(agent, map[string]string{"redis:6": "backup:redis_6"})
+	inv.recordBackup("redis:6", "backup:redis_6", "sha256:aaa")
+
+	backups := inv.backups()
+	require.Len(t, backups, 2)
+	require.Equal(t, "redis:6", backups[1].Source)
+	require.Equal(t, []string{"DaemonSet/test/agent", "Deployment/test/web"}, backups[1].workloadNames())
+	require.Equal(t, upstreamAvailable, backups[1].UpstreamState)
+
+	//web is upgraded and does not use redis anymore
+	inv.setReferences(web, map[string]string{"nginx:1.20": "backup:nginx_1.20"})
+	inv.forgetWorkload(agent)
+	for _, b := range inv.backups() {
+		switch b.Source {
+		case "nginx:1.20":
+			require.Equal(t, []string{"Deployment/test/web"}, b.workloadNames())
+		default:
+			require.Empty(t, b.Workloads)
+		}
+	}
+
+	require.True(t, inv.setUpstream("redis:6", "backup:redis_6", upstreamDeleted, ""))
+	require.False(t, inv.setUpstream("redis:6", "backup:redis_6", upstreamDeleted, ""))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// periodicJob is manager.Runnable, that runs fn every interval (until manager is stopped).
+// As other controller logic, jobs run on the leader only, unless everyReplica is set
+// (i.e. with sharding, jobs over inventory of the shard run on every replica)
+type periodicJob struct {
+	name         string
+	interval     time.Duration
+	fn           func(ctx context.Context)
+	everyReplica bool
+}
+
+var (
+	_ manager.Runnable               = &periodicJob{}
+	_ manager.LeaderElectionRunnable = &periodicJob{}
+)
+
+// Start runs the job until context is done
+func (j *periodicJob) Start(ctx context.Context) error {
+	lg := log.FromContext(ctx).WithName(j.name)
+	lg.Info("starting periodic job", "interval", j.interval.String())
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			j.fn(log.IntoContext(ctx, lg))
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// NeedLeaderElection makes the job to run on the leader only, unless everyReplica is set
+func (j *periodicJob) NeedLeaderElection() bool {
+	return !j.everyReplica
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// errNoSelector is returned for objects of custom kinds without spec.selector (i.e. Knative Service),
+// which do not select their pods by labels
+var errNoSelector = errors.New("no selector")
+
+// customKind is workloadAdapter of kinds (i.e. Argo Rollout, Knative Service) managed in addition
+// to Deployment and DaemonSet. Objects of custom kinds are handled as unstructured, with pod
+// spec (holding containers and initContainers) found at podSpecPath
+type customKind struct {
+	gvk         schema.GroupVersionKind
+	podSpecPath []string
+}
+
+// name returns name of the kind, as used in workload references: Kind.group (Kind for core group)
+func (k customKind) name() string {
+	if k.gvk.Group == "" {
+		return k.gvk.Kind
+	}
+	return k.gvk.Kind + "." + k.gvk.Group
+}
+
+// parseCustomKind parses kind as `group/version/Kind=path.to.pod.spec`,
+// i.e. `argoproj.io/v1alpha1/Rollout=spec.template.spec`
+func parseCustomKind(value string) (customKind, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return customKind{}, fmt.Errorf("expected group/version/Kind=path.to.pod.spec, got %q", value)
+	}
+
+	gvk := strings.Split(parts[0], "/")
+	if len(gvk) != 3 || gvk[1] == "" || gvk[2] == "" {
+		return customKind{}, fmt.Errorf("expected group/version/Kind in %q", value)
+	}
+	k := customKind{
+		gvk:         schema.GroupVersionKind{Group: gvk[0], Version: gvk[1], Kind: gvk[2]},
+		podSpecPath: strings.Split(parts[1], "."),
+	}
+	if k.gvk.Group == appsv1.GroupName && (k.gvk.Kind == "Deployment" || k.gvk.Kind == "DaemonSet") {
+		return customKind{}, fmt.Errorf("%s is supported already", k.gvk.Kind)
+	}
+	return k, nil
+}
+
+// registerCustomKind makes the kind managed by the controller
+func registerCustomKind(k customKind) {
+	workloadKinds[k.name()] = k
+}
+
+// customKindOf returns custom kind of unstructured object
+func customKindOf(u *unstructured.Unstructured) (customKind, error) {
+	gvk := u.GroupVersionKind()
+	k, registered := workloadKinds[customKind{gvk: gvk}.name()].(customKind)
+	if !registered {
+		return customKind{}, fmt.Errorf("kind %s is not registered", gvk.String())
+	}
+	return k, nil
+}
+
+// asUnstructured returns the object as unstructured object of the kind
+func (k customKind) asUnstructured(obj client.Object) (*unstructured.Unstructured, error) {
+	u, isUnstructured := obj.(*unstructured.Unstructured)
+	if !isUnstructured || u.GroupVersionKind() != k.gvk {
+		return nil, fmt.Errorf("object of type %T is not %s", obj, k.name())
+	}
+	return u, nil
+}
+
+func (k customKind) kind() string { return k.name() }
+
+// newObject returns empty unstructured object of the kind
+func (k customKind) newObject() client.Object {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(k.gvk)
+	return u
+}
+
+// newList returns empty unstructured list of objects of the kind
+func (k customKind) newList() client.ObjectList {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(k.gvk.GroupVersion().WithKind(k.gvk.Kind + "List"))
+	return list
+}
+
+// podSpec returns copy of pod spec of the unstructured object
+func (k customKind) podSpec(obj client.Object) (*v1.PodSpec, error) {
+	u, err := k.asUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	m, found, err := unstructured.NestedMap(u.Object, k.podSpecPath...)
+	if err != nil || !found {
+		return nil, fmt.Errorf("no pod spec at %s of %s %s: %v", strings.Join(k.podSpecPath, "."), k.name(), u.GetName(), err)
+	}
+
+	podSpec := &v1.PodSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(m, podSpec); err != nil {
+		return nil, fmt.Errorf("could not parse pod spec of %s %s: %w", k.name(), u.GetName(), err)
+	}
+	return podSpec, nil
+}
+
+// podTemplate returns pod spec, since pod templates of custom kinds may have no metadata
+func (k customKind) podTemplate(obj client.Object) (interface{}, error) {
+	return k.podSpec(obj)
+}
+
+// containers returns containers and initContainers lists of the unstructured object,
+// by their field names. Missing lists are omitted
+func (k customKind) containers(u *unstructured.Unstructured) (map[string][]interface{}, error) {
+	lists := map[string][]interface{}{}
+	for _, field := range []string{"containers", "initContainers"} {
+		containers, found, err := unstructured.NestedSlice(u.Object, append(append([]string{}, k.podSpecPath...), field)...)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			lists[field] = containers
+		}
+	}
+	return lists, nil
+}
+
+// rewriteImages replaces images of containers lists of the unstructured object
+func (k customKind) rewriteImages(obj client.Object, mapping map[string]string) error {
+	u, err := k.asUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	lists, err := k.containers(u)
+	if err != nil {
+		return err
+	}
+	for field, containers := range lists {
+		for _, c := range containers {
+			container, isMap := c.(map[string]interface{})
+			if !isMap {
+				continue
+			}
+			if image, found := mapping[fmt.Sprint(container["image"])]; found {
+				container["image"] = image
+			}
+		}
+		if err := unstructured.SetNestedSlice(u.Object, containers, append(append([]string{}, k.podSpecPath...), field)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imagePatch returns JSON merge patch, that sets containers and the annotations of unstructured
+// object (CRDs do not support strategic merge patch, so containers lists are written as a whole,
+// guarded by resourceVersion)
+func (k customKind) imagePatch(obj client.Object, annotations map[string]interface{}) (types.PatchType, []byte, error) {
+	u, err := k.asUnstructured(obj)
+	if err != nil {
+		return "", nil, err
+	}
+	lists, err := k.containers(u)
+	if err != nil {
+		return "", nil, err
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": u.GetResourceVersion(),
+			"annotations":     annotations,
+		},
+	}
+	for field, containers := range lists {
+		if err := unstructured.SetNestedSlice(patch, containers, append(append([]string{}, k.podSpecPath...), field)...); err != nil {
+			return "", nil, err
+		}
+	}
+	data, err := json.Marshal(patch)
+	return types.MergePatchType, data, err
+}
+
+// selector returns pod selector of unstructured object from spec.selector,
+// which is either label selector or map of labels
+func (k customKind) selector(obj client.Object) (labels.Selector, error) {
+	u, err := k.asUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	selector, found, err := unstructured.NestedMap(u.Object, "spec", "selector")
+	if err != nil || !found {
+		return nil, fmt.Errorf("%w in %s %s", errNoSelector, k.name(), u.GetName())
+	}
+
+	_, hasLabels := selector["matchLabels"]
+	_, hasExpressions := selector["matchExpressions"]
+	if !hasLabels && !hasExpressions {
+		set := labels.Set{}
+		for key, value := range selector {
+			set[key] = fmt.Sprint(value)
+		}
+		return labels.SelectorFromSet(set), nil
+	}
+
+	labelSelector := &metav1.LabelSelector{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(selector, labelSelector); err != nil {
+		return nil, err
+	}
+	return metav1.LabelSelectorAsSelector(labelSelector)
+}
+
+// rolloutComplete considers rollout complete, since status of custom kinds is not known
+// (so their rollouts are not watched, see rolloutWatched)
+func (k customKind) rolloutComplete(obj client.Object) bool {
+	return true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func Test_parseCustomKind(t *testing.T) {
+	k, err := parseCustomKind("argoproj.io/v1alpha1/Rollout=spec.template.spec")
+	require.NoError(t, err)
+	require.Equal(t, "Rollout.argoproj.io", k.name())
+	require.Equal(t, []string{"spec", "template", "spec"}, k.podSpecPath)
+
+	for _, value := range []string{
+		"argoproj.io/v1alpha1/Rollout",
+		"argoproj.io/Rollout=spec.template.spec",
+		"apps/v1/Deployment=spec.template.spec",
+	} {
+		_, err := parseCustomKind(value)
+		require.Error(t, err, value)
+	}
+}
+
+// Test_customKindImages checks images of unstructured workload are read, rewritten and patched
+func Test_customKindImages(t *testing.T) {
+	k, err := parseCustomKind("argoproj.io/v1alpha1/Rollout=spec.template.spec")
+	require.NoError(t, err)
+	registerCustomKind(k)
+	defer delete(workloadKinds, k.name())
+
+	u := k.newObject().(*unstructured.Unstructured)
+	u.SetName("web")
+	u.SetNamespace("test")
+	u.SetResourceVersion("7")
+	require.NoError(t, unstructured.SetNestedSlice(u.Object, []interface{}{
+		map[string]interface{}{"name": "nginx", "image": "nginx:1.19"},
+		map[string]interface{}{"name": "envoy", "image": "envoyproxy/envoy:v1.17"},
+	}, "spec", "template", "spec", "containers"))
+	require.NoError(t, unstructured.SetNestedField(u.Object, map[string]interface{}{"app": "web"},
+		"spec", "selector", "matchLabels"))
+	require.Equal(t, "Rollout.argoproj.io", kindOf(u))
+
+	podSpec, err := podSpecOf(u)
+	require.NoError(t, err)
+	require.Len(t, podSpec.Containers, 2)
+	require.Equal(t, "nginx:1.19", podSpec.Containers[0].Image)
+
+	selector, err := selectorOf(u)
+	require.NoError(t, err)
+	require.Equal(t, "app=web", selector.String())
+
+	require.NoError(t, rewriteWorkloadImages(u, map[string]string{"nginx:1.19": "backup:nginx_1.19"}))
+	podSpec, err = podSpecOf(u)
+	require.NoError(t, err)
+	require.Equal(t, "backup:nginx_1.19", podSpec.Containers[0].Image)
+	require.Equal(t, "envoyproxy/envoy:v1.17", podSpec.Containers[1].Image)
+
+	setSourceImages(u, map[string]string{"backup:nginx_1.19": "nginx:1.19"})
+	patchType, data, err := imagePatch(u)
+	require.NoError(t, err)
+	require.Equal(t, "application/merge-patch+json", string(patchType))
+
+	patch := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(data, &patch))
+	require.Equal(t, "7", patch["metadata"].(map[string]interface{})["resourceVersion"])
+	containers, found, err := unstructured.NestedSlice(patch, "spec", "template", "spec", "containers")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "backup:nginx_1.19", containers[0].(map[string]interface{})["image"])
+	_, found, err = unstructured.NestedSlice(patch, "spec", "template", "spec", "initContainers")
+	require.NoError(t, err)
+	require.False(t, found)
+}
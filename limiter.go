@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// registryLimiter caps the number of parallel copies per source registry.
+// It is shared between all reconcile workers, so the limits are
+// controller wide (i.e. to stay under Docker Hub rate limits)
+type registryLimiter struct {
+	mu           sync.Mutex
+	limits       map[string]int           //registry -> max parallel copies
+	defaultLimit int                      //limit for registries not listed in limits
+	slots        map[string]chan struct{} //registry -> semaphore
+}
+
+// newRegistryLimiter creates limiter. Registry names in limits are normalized,
+// so `docker.io` and `index.docker.io` refer to the same registry
+func newRegistryLimiter(limits map[string]int, defaultLimit int) *registryLimiter {
+	l := &registryLimiter{
+		limits:       make(map[string]int, len(limits)),
+		defaultLimit: defaultLimit,
+		slots:        map[string]chan struct{}{},
+	}
+	if l.defaultLimit < 1 {
+		l.defaultLimit = 1
+	}
+	for registry, limit := range limits {
+		l.limits[normalizeRegistry(registry)] = limit
+	}
+	return l
+}
+
+// normalizeRegistry returns canonical registry name as used by go-containerregistry
+func normalizeRegistry(registry string) string {
+	reg, err := name.NewRegistry(registry)
+	if err != nil {
+		return registry
+	}
+	return reg.RegistryStr()
+}
+
+// semaphore returns (lazily created) semaphore of the registry
+func (l *registryLimiter) semaphore(registry string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sem, exists := l.slots[registry]
+	if !exists {
+		limit, configured := l.limits[registry]
+		if !configured {
+			limit = l.defaultLimit
+		}
+		sem = make(chan struct{}, limit)
+		l.slots[registry] = sem
+	}
+	return sem
+}
+
+// acquire blocks until a copy slot for the registry is available, or context is done.
+// Returned function must be called to release the slot
+func (l *registryLimiter) acquire(ctx context.Context, registry string) (func(), error) {
+	sem := l.semaphore(normalizeRegistry(registry))
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
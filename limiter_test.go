@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_registryLimiter checks that limits are applied per normalized registry name
+func Test_registryLimiter(t *testing.T) {
+	l := newRegistryLimiter(map[string]int{"docker.io": 1}, 2)
+
+	release, err := l.acquire(context.Background(), "index.docker.io")
+	require.Nil(t, err)
+
+	//docker.io has single slot, which is taken
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx, "docker.io")
+	require.NotNil(t, err)
+
+	//other registries are not affected
+	releaseQuay, err := l.acquire(context.Background(), "quay.io")
+	require.Nil(t, err)
+	releaseQuay()
+
+	release()
+	release, err = l.acquire(context.Background(), "docker.io")
+	require.Nil(t, err)
+	release()
+}
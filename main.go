@@ -17,20 +17,30 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/google/go-containerregistry/pkg/authn"
-	appsv1 "k8s.io/api/apps/v1"
+	imgv1alpha1 "github.com/i-prudnikov/imgCloneCtrl/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"os"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sort"
+	"strings"
+	"time"
 )
 
 var (
@@ -67,6 +77,100 @@ func main() {
 		entryLog.Info("using backup registry: " + argBackupRegistry)
 	}
 
+	if argMaxConcurrentReconciles < 1 || argMaxConcurrentCopies < 1 {
+		entryLog.Error(nil, "--maxConcurrentReconciles and --maxConcurrentCopies must be positive!")
+		flag.Usage()
+		os.Exit(1)
+	}
+	entryLog.Info(fmt.Sprintf("concurrency: reconciles %d, copies per reconcile %d, per registry: %s (default %d)",
+		argMaxConcurrentReconciles, argMaxConcurrentCopies, argRegistryConcurrency.String(), argDefaultRegistryLimit))
+
+	switch argRewriteMode {
+	case rewriteModeAlways, rewriteModeStandby, rewriteModeDeferred:
+		entryLog.Info("rewrite mode: " + argRewriteMode)
+	default:
+		entryLog.Error(nil, "--rewriteMode must be one of 'always', 'standby' or 'deferred'!")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch argTagMutationPolicy {
+	case tagMutationPreserve, tagMutationHistory, tagMutationOverwrite:
+		entryLog.Info("tag mutation policy: " + argTagMutationPolicy)
+	default:
+		entryLog.Error(nil, "--tagMutationPolicy must be one of 'preserve', 'history' or 'overwrite'!")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var windows []maintenanceWindow
+	for value := range argMaintenanceWindows {
+		w, err := parseMaintenanceWindow(value)
+		if err != nil {
+			entryLog.Error(err, "invalid --maintenanceWindow")
+			flag.Usage()
+			os.Exit(1)
+		}
+		windows = append(windows, w)
+	}
+	for value := range argWorkloadKinds {
+		k, err := parseCustomKind(value)
+		if err != nil {
+			entryLog.Error(err, "invalid --workloadKind")
+			flag.Usage()
+			os.Exit(1)
+		}
+		registerCustomKind(k)
+	}
+
+	namespaceSelector, err := parseNamespaceSelector(argNamespaceSelector)
+	if err != nil {
+		entryLog.Error(err, "invalid --namespaceSelector")
+		flag.Usage()
+		os.Exit(1)
+	}
+	ignoreNamespaceSelector, err := parseNamespaceSelector(argIgnoreNamespaceSelector)
+	if err != nil {
+		entryLog.Error(err, "invalid --ignoreNamespaceSelector")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var watchNamespaces []string
+	for namespace := range argWatchNamespaces {
+		watchNamespaces = append(watchNamespaces, namespace)
+	}
+	sort.Strings(watchNamespaces)
+	if len(watchNamespaces) != 0 && (namespaceSelector != nil || ignoreNamespaceSelector != nil) {
+		entryLog.Error(nil, "--namespaceSelector and --ignoreNamespaceSelector can't be used with --watchNamespace!")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	filter, err := newImageFilter(argIncludeImages, argExcludeImages, argIncludeRegistries, argExcludeRegistries)
+	if err != nil {
+		entryLog.Error(err, "invalid image or registry pattern")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if argRewriteBudget < 0 || argRewriteBudgetPerNamespace < 0 || argRewriteBudgetInterval <= 0 {
+		entryLog.Error(nil, "--rewriteBudget and --rewriteBudgetPerNamespace must not be negative, --rewriteBudgetInterval must be positive!")
+		flag.Usage()
+		os.Exit(1)
+	}
+	entryLog.Info(fmt.Sprintf("rewrite budget: %d (%d per namespace) within %s, maintenance windows: %s",
+		argRewriteBudget, argRewriteBudgetPerNamespace, argRewriteBudgetInterval, argMaintenanceWindows.String()))
+
+	switch argPodRescue {
+	case podRescueOff, podRescueEvent, podRescuePatch:
+		entryLog.Info("pod rescue: " + argPodRescue)
+	default:
+		entryLog.Error(nil, "--podRescue must be one of 'off', 'event' or 'patch'!")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	//TODO (i-prudnikov): Check for validity
 	if argLeaderElectionID == ""  {
 		entryLog.Error(nil, "--leaderElectionID is not specified!")
@@ -81,14 +185,52 @@ func main() {
 		os.Exit(1)
 	}
 
+	if argSharding && argGCInterval > 0 {
+		entryLog.Error(nil, "--gcInterval can't be used with --sharding, since every replica knows backups of its shard only!")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if argSharding && argShardLeaseDuration < 3*time.Second {
+		entryLog.Error(nil, "--shardLeaseDuration must be at least 3s!")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if argInventoryNamespace == "" {
+		argInventoryNamespace = os.Getenv("NAMESPACE")
+	}
+	if argInventorySyncInterval > 0 && argInventoryNamespace == "" {
+		entryLog.Error(nil, "--inventoryNamespace is not specified!")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	//Scheme with built-in types and ClonedImage
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		entryLog.Error(err, "unable to set up scheme")
+		os.Exit(1)
+	}
+	if err := imgv1alpha1.AddToScheme(scheme); err != nil {
+		entryLog.Error(err, "unable to set up scheme")
+		os.Exit(1)
+	}
+
 	// Setup a Manager
 	entryLog.Info("setting up manager")
 	//TODO (i-prudnikov): Switch off leader election if LeaderElectionID is not provided
-	mgr, err := manager.New(config.GetConfigOrDie(), manager.Options{
-		LeaderElection: true,
-		LeaderElectionID: argLeaderElectionID,
+	mgrOptions := manager.Options{
+		Scheme:                  scheme,
+		LeaderElection:          true,
+		LeaderElectionID:        argLeaderElectionID,
 		LeaderElectionNamespace: argLeaderElectionNamespace,
-	})
+	}
+	if len(watchNamespaces) != 0 {
+		//Objects are cached (and so listed and watched) within watched namespaces only
+		entryLog.Info("namespaces to watch: " + strings.Join(watchNamespaces, ","))
+		mgrOptions.NewCache = cache.MultiNamespacedCacheBuilder(watchNamespaces)
+	}
+	mgr, err := manager.New(config.GetConfigOrDie(), mgrOptions)
 	if err != nil {
 		entryLog.Error(err, "unable to set up overall controller manager")
 		os.Exit(1)
@@ -96,40 +238,167 @@ func main() {
 
 	// Setup a new controller to reconcile Deployments & DaemonSets
 	entryLog.Info("setting up controller")
-	ctrl, err := controller.New("ImgCloneCtrl", mgr, controller.Options{
-		Reconciler: &reconciler{
-			client:            mgr.GetClient(),
-			ignoredNamespaces: argIgnoreNamespaces,
-			backupRegistry:    argBackupRegistry,
-			authConfig: authn.AuthConfig{
-				Username: argBackupRegistryUser,
-				Password: argBackupRegistryPassword,
-			},
+	imgReconciler := &reconciler{
+		client:            mgr.GetClient(),
+		ignoredNamespaces: argIgnoreNamespaces,
+		namespaceSelector: namespaceSelector,
+		namespaceScoped:   len(watchNamespaces) != 0,
+		ignoreSelector:    ignoreNamespaceSelector,
+		backupRegistry:    argBackupRegistry,
+		authConfig: authn.AuthConfig{
+			Username: argBackupRegistryUser,
+			Password: argBackupRegistryPassword,
 		},
-	})
+		maxConcurrentCopies:  argMaxConcurrentCopies,
+		registryLimiter:      newRegistryLimiter(argRegistryConcurrency, argDefaultRegistryLimit),
+		copyCoordinator:      newCopyCoordinator(argCopyCacheTTL),
+		digests:              newDigestCache(argDigestCacheTTL),
+		backoff:              newBackoffTracker(),
+		blobRetries:          argBlobRetries,
+		copyTimeoutBase:      argCopyTimeoutBase,
+		minCopyThroughput:    int64(argMinCopyThroughput) * 1024,
+		rewriteMode:          argRewriteMode,
+		probeInterval:        argStandbyProbeInterval,
+		standbyRevert:        argStandbyRevert,
+		tagMutationPolicy:    argTagMutationPolicy,
+		rolloutDeadline:      argRolloutDeadline,
+		rolloutCheckInterval: argRolloutCheckInterval,
+		apiReader:            mgr.GetAPIReader(),
+		rewriteBudget:        newRewriteBudget(argRewriteBudgetInterval, argRewriteBudget, argRewriteBudgetPerNamespace, windows),
+		imageFilter:          filter,
+		registries:           newBackupRegistries(),
+		recorder:             mgr.GetEventRecorderFor("imgCloneCtrl"),
+		inventory:            newInventory(),
+	}
 
-	if err != nil {
-		entryLog.Error(err, "unable to set up image clone controller")
-		os.Exit(1)
+	// With sharding, controllers run on every replica and each replica reconciles workloads of its own
+	// namespaces. Workloads are enqueued via channels of their kinds, once namespaces move between replicas
+	ctrlMgr := manager.Manager(mgr)
+	shardEvents := map[string]chan event.GenericEvent{}
+	if argSharding {
+		identity, err := os.Hostname()
+		if err != nil {
+			entryLog.Error(err, "unable to get identity of replica")
+			os.Exit(1)
+		}
+		imgReconciler.shards = newShardMembership(mgr.GetClient(), mgr.GetAPIReader(), argLeaderElectionNamespace,
+			argLeaderElectionID, identity, argShardLeaseDuration)
+		ctrlMgr = everyReplicaManager{mgr}
 	}
 
-	//NOTE!
-	//The following Watch calls uses handler.EnqueueRequestsFromMapFunc, that
-	//enriches reconcile.Request with `kind` information about the object
-	//This allows to use the single handler for both Deployment and DaemonSet.
-	//The standard approach would be to create different handlers per every object,
-	//but this lead to duplication of code.
+	// Every kind of workloads is reconciled by its own controller, requests are keys of the objects.
+	// Pods enqueue their owners, so images missing in pod templates (sidecars, ephemeral containers) are backed up.
+	// Namespaces, when selected by labels, enqueue their workloads once labels change
+	for _, adapter := range workloadKinds {
+		kindCtrl := builder.ControllerManagedBy(ctrlMgr).
+			Named("ImgCloneCtrl-"+adapter.kind()).
+			For(adapter.newObject(), builder.WithPredicates(ignoreStatusUpdates)).
+			Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(imgReconciler.podOwnerRequests(adapter.kind())),
+				builder.WithPredicates(podImagesChanged))
+		if imgReconciler.usesNamespaceLabels() {
+			kindCtrl = kindCtrl.Watches(&source.Kind{Type: &corev1.Namespace{}}, handler.EnqueueRequestsFromMapFunc(imgReconciler.namespaceWorkloads(adapter)),
+				builder.WithPredicates(namespaceLabelsChanged))
+		}
+		if imgReconciler.shards != nil {
+			events := make(chan event.GenericEvent)
+			shardEvents[adapter.kind()] = events
+			kindCtrl = kindCtrl.Watches(&source.Channel{Source: events}, &handler.EnqueueRequestForObject{})
+		}
+		err := kindCtrl.
+			WithOptions(controller.Options{MaxConcurrentReconciles: argMaxConcurrentReconciles}).
+			Complete(imgReconciler.forKind(adapter))
+		if err != nil {
+			entryLog.Error(err, "unable to set up image clone controller for "+adapter.kind())
+			os.Exit(1)
+		}
+	}
 
-	// Watch Deployment and enqueue object key (enriched with object kind)
-	if err := ctrl.Watch(&source.Kind{Type: &appsv1.Deployment{}}, handler.EnqueueRequestsFromMapFunc(withKind)); err != nil {
-		entryLog.Error(err, "unable to watch Deployments")
-		os.Exit(1)
+	if imgReconciler.shards != nil {
+		imgReconciler.shards.onChange = func(ctx context.Context) {
+			for kind, events := range shardEvents {
+				imgReconciler.shardWorkloads(ctx, workloadKinds[kind], events)
+			}
+		}
+		if err := mgr.Add(imgReconciler.shards); err != nil {
+			entryLog.Error(err, "unable to set up shard membership")
+			os.Exit(1)
+		}
 	}
 
-	// Watch DaemonSet and enqueue object key (enriched with object kind)
-	if err := ctrl.Watch(&source.Kind{Type: &appsv1.DaemonSet{}}, handler.EnqueueRequestsFromMapFunc(withKind)); err != nil {
-		entryLog.Error(err, "unable to watch DaemonSets")
-		os.Exit(1)
+	// Setup a controller rescuing pods, that could not pull upstream images
+	if argPodRescue != podRescueOff {
+		rescueCtrl, err := controller.New("PodRescue", ctrlMgr, controller.Options{
+			Reconciler: &podRescuer{r: imgReconciler, policy: argPodRescue},
+		})
+		if err != nil {
+			entryLog.Error(err, "unable to set up pod rescue controller")
+			os.Exit(1)
+		}
+		if err := rescueCtrl.Watch(&source.Kind{Type: &corev1.Pod{}}, &handler.EnqueueRequestForObject{}, pullFailing); err != nil {
+			entryLog.Error(err, "unable to watch Pods")
+			os.Exit(1)
+		}
+	}
+
+	// Periodic check of upstream images, that were backed up
+	if argUpstreamCheckInterval > 0 {
+		if err := mgr.Add(&periodicJob{
+			name:         "upstream-monitor",
+			interval:     argUpstreamCheckInterval,
+			fn:           imgReconciler.checkUpstream,
+			everyReplica: argSharding,
+		}); err != nil {
+			entryLog.Error(err, "unable to set up upstream monitor")
+			os.Exit(1)
+		}
+	}
+
+	// Periodic verification of backups
+	if argVerifyInterval > 0 {
+		if err := mgr.Add(&periodicJob{
+			name:         "backup-verifier",
+			interval:     argVerifyInterval,
+			fn:           imgReconciler.verifyBackups,
+			everyReplica: argSharding,
+		}); err != nil {
+			entryLog.Error(err, "unable to set up backup verifier")
+			os.Exit(1)
+		}
+	}
+
+	// Garbage collection of unreferenced backups
+	if argGCInterval > 0 {
+		protected := make([]string, 0, len(argGCProtectTags))
+		for pattern := range argGCProtectTags {
+			protected = append(protected, pattern)
+		}
+		gc := newBackupGC(imgReconciler, argGCRetention, argGCDryRun, protected)
+		if err := mgr.Add(&periodicJob{name: "backup-gc", interval: argGCInterval, fn: gc.run}); err != nil {
+			entryLog.Error(err, "unable to set up backup GC")
+			os.Exit(1)
+		}
+	}
+
+	// Persisting inventory of backed up images as ClonedImage resources
+	if argInventorySyncInterval > 0 {
+		store := &inventoryStore{client: mgr.GetClient(), reader: mgr.GetAPIReader(), namespace: argInventoryNamespace, shards: imgReconciler.shards}
+		// Inventory is loaded before controllers start, so workloads reconciled first
+		// do not persist records without backup details. The first sync loads it again,
+		// once inventory persisted by the previous leader is complete
+		loadCtx, cancelLoad := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := store.load(loadCtx, imgReconciler.inventory); err != nil {
+			entryLog.Error(err, "could not preload inventory")
+		}
+		cancelLoad()
+		if err := mgr.Add(&periodicJob{
+			name:         "inventory-sync",
+			interval:     argInventorySyncInterval,
+			fn:           func(ctx context.Context) { store.sync(ctx, imgReconciler.inventory) },
+			everyReplica: argSharding,
+		}); err != nil {
+			entryLog.Error(err, "unable to set up inventory sync")
+			os.Exit(1)
+		}
 	}
 
 	entryLog.Info("starting manager")
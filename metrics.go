@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	// manifestRequestsAvoided counts manifest GET requests (rate limited by Docker Hub),
+	// that were not issued thanks to HEAD requests or cached digests
+	manifestRequestsAvoided = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgclonectrl_manifest_requests_avoided_total",
+		Help: "Number of manifest GET requests avoided, by registry and reason (head, cache)",
+	}, []string{"registry", "reason"})
+
+	// manifestRequests counts manifest GET requests actually issued
+	manifestRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgclonectrl_manifest_requests_total",
+		Help: "Number of manifest GET requests issued, by registry",
+	}, []string{"registry"})
+
+	// blobRetries counts retried blob uploads to backup registry
+	blobRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgclonectrl_blob_upload_retries_total",
+		Help: "Number of retried blob uploads, by backup registry",
+	}, []string{"registry"})
+
+	// upstreamImages is the number of backed up images by the state of upstream image
+	upstreamImages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imgclonectrl_upstream_images",
+		Help: "Number of backed up images by upstream state (Available, Deleted, Moved), as seen by the last check",
+	}, []string{"state"})
+
+	// upstreamChanges counts detected disappearances of upstream images
+	upstreamChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgclonectrl_upstream_changes_total",
+		Help: "Number of detected deletions or moves of upstream images, by state (Deleted, Moved)",
+	}, []string{"state"})
+
+	// upstreamUnavailable is the number of backed up images deleted or moved upstream, by source registry
+	// (images themselves are listed in logs and events, series per image would grow without bound)
+	upstreamUnavailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imgclonectrl_upstream_unavailable_images",
+		Help: "Number of backed up images deleted or moved upstream, by source registry and state (Deleted, Moved), as seen by the last check",
+	}, []string{"registry", "state"})
+
+	// tagMutations counts backups found to differ from upstream tag
+	tagMutations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgclonectrl_tag_mutations_total",
+		Help: "Number of backups found to hold image different from upstream tag, by applied policy",
+	}, []string{"policy"})
+
+	// backupRepairs counts broken backups pushed again from upstream by verification
+	backupRepairs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "imgclonectrl_backup_repairs_total",
+		Help: "Number of broken backups pushed again from upstream",
+	})
+
+	// backupLost is set for every broken backup, that can not be repaired, since upstream image is gone
+	backupLost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imgclonectrl_backup_lost",
+		Help: "Set to 1 for broken backups that were the last copy of the image (upstream image is gone)",
+	}, []string{"source", "target"})
+
+	// gcCandidates is the number of backup images selected for deletion by the last GC pass
+	gcCandidates = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "imgclonectrl_gc_candidates",
+		Help: "Number of unreferenced backup images selected for deletion by the last GC pass",
+	})
+
+	// gcDeleted counts backup images deleted by GC
+	gcDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "imgclonectrl_gc_deleted_total",
+		Help: "Number of backup images deleted by GC",
+	})
+
+	// shardMembers is the number of replicas sharing namespaces, as seen by this replica
+	shardMembers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "imgclonectrl_shard_members",
+		Help: "Number of replicas with valid shard Leases, as seen by this replica",
+	})
+)
+
+func init() {
+	//Metrics are served by the manager on /metrics
+	metrics.Registry.MustRegister(manifestRequestsAvoided, manifestRequests, blobRetries,
+		upstreamImages, upstreamChanges, upstreamUnavailable, tagMutations,
+		backupRepairs, backupLost, gcCandidates, gcDeleted, shardMembers)
+}
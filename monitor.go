@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// upstreamState checks upstream image of the backup record. Empty state is
+// returned if it could not be determined (i.e. network errors)
+func (r *reconciler) upstreamState(ctx context.Context, record backupRecord) (state, digest string) {
+	ref, err := name.ParseReference(record.Source)
+	if err != nil {
+		return "", ""
+	}
+
+	hash, err := r.sourceDigest(ref, remote.WithAuth(authn.Anonymous), remote.WithContext(ctx))
+	if err != nil {
+		if isUpstreamGone(ref, err) {
+			return upstreamDeleted, ""
+		}
+		return "", ""
+	}
+
+	if hash.String() != record.Digest {
+		return upstreamMoved, hash.String()
+	}
+	return upstreamAvailable, hash.String()
+}
+
+// checkUpstream checks every backed up source image, whether it's still available upstream.
+// When upstream image is deleted or its tag is moved to a different digest, this is
+// reported with metrics, log entry listing affected workloads and events on the workloads.
+func (r *reconciler) checkUpstream(ctx context.Context) {
+	lg := log.FromContext(ctx)
+	counts := map[string]float64{upstreamAvailable: 0, upstreamDeleted: 0, upstreamMoved: 0}
+	unavailable := map[[2]string]float64{} //registry, state -> number of images
+
+	for _, record := range r.inventory.backups() {
+		if ctx.Err() != nil {
+			return
+		}
+		if !r.shards.ownsBackup(record) { //checked by replicas owning its workloads
+			continue
+		}
+
+		//Digest of images backed up before controller restart is taken from backup registry
+		if record.Digest == "" {
+			dstRef, err := name.ParseReference(record.Target)
+			if err != nil {
+				continue
+			}
+			digest, err := targetDigest(dstRef, r.targetAuth(dstRef, record.namespaces()...), remote.WithContext(ctx))
+			if err != nil {
+				continue
+			}
+			record.Digest = digest.String()
+			r.inventory.setDigest(record.Source, record.Target, record.Digest)
+		}
+
+		state, digest := r.upstreamState(ctx, record)
+		if state == "" {
+			continue
+		}
+		counts[state]++
+		if state != upstreamAvailable {
+			if ref, err := name.ParseReference(record.Source); err == nil {
+				unavailable[[2]string{ref.Context().RegistryStr(), state}]++
+			}
+		}
+
+		if !r.inventory.setUpstream(record.Source, record.Target, state, digest) {
+			continue
+		}
+
+		workloads := record.workloadNames()
+
+		var message string
+		switch state {
+		case upstreamAvailable:
+			if record.UpstreamState == "" {
+				continue //first check
+			}
+			lg.Info(fmt.Sprintf("upstream image %q is available again", record.Source))
+			continue
+		case upstreamDeleted:
+			message = fmt.Sprintf("upstream image %q was deleted, backup %q is the only copy", record.Source, record.Target)
+		case upstreamMoved:
+			message = fmt.Sprintf("upstream image %q was moved from %s to %s, backup %q holds the previous one",
+				record.Source, record.Digest, digest, record.Target)
+		}
+
+		upstreamChanges.WithLabelValues(state).Inc()
+		lg.Info(message, "workloads", strings.Join(workloads, ","))
+
+		r.workloadEvents(ctx, record, v1.EventTypeWarning, "Upstream"+state, message)
+	}
+
+	for state, count := range counts {
+		upstreamImages.WithLabelValues(state).Set(count)
+	}
+	upstreamUnavailable.Reset()
+	for key, count := range unavailable {
+		upstreamUnavailable.WithLabelValues(key[0], key[1]).Set(count)
+	}
+}
+
+// workloadEvents records an event on every workload using the backup image
+func (r *reconciler) workloadEvents(ctx context.Context, record backupRecord, eventType, reason, message string) {
+	for w := range record.Workloads {
+		if !r.shards.owns(w.Namespace) {
+			continue
+		}
+		obj, err := newWorkload(w.Kind)
+		if err != nil {
+			continue
+		}
+		if err := r.client.Get(ctx, types.NamespacedName{Namespace: w.Namespace, Name: w.Name}, obj); err != nil {
+			continue
+		}
+		r.event(obj, eventType, reason, message)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// Test_checkUpstream checks upstream images moved, deleted and available again are
+// reported with events on workloads using them and with metrics
+func Test_checkUpstream(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	srcRef, err := name.ParseReference(u.Host + "/library/nginx:1.19")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(srcRef, img))
+	dst := u.Host + "/backup:library_nginx_1.19"
+
+	web := workloadRef{Kind: "Deployment", Namespace: "test", Name: "web"}
+	inv := newInventory()
+	inv.setReferences(web, map[string]string{srcRef.String(): dst})
+	inv.recordBackup(srcRef.String(), dst, digest.String())
+
+	recorder := record.NewFakeRecorder(10)
+	r := &reconciler{
+		client:    fake.NewClientBuilder().WithObjects(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "web"}}).Build(),
+		inventory: inv,
+		recorder:  recorder,
+	}
+	ctx := context.Background()
+	upstreamState := func() string {
+		backups := inv.backups()
+		require.Len(t, backups, 1)
+		return backups[0].UpstreamState
+	}
+
+	r.checkUpstream(ctx)
+	require.Equal(t, upstreamAvailable, upstreamState())
+	require.Empty(t, recorder.Events)
+	require.Equal(t, 0, testutil.CollectAndCount(upstreamUnavailable))
+
+	//Available -> Moved
+	moved, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(srcRef, moved))
+	r.checkUpstream(ctx)
+	require.Equal(t, upstreamMoved, upstreamState())
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, "UpstreamMoved")
+	require.Equal(t, float64(1), testutil.ToFloat64(upstreamUnavailable.WithLabelValues(u.Host, upstreamMoved)))
+
+	//Moved -> Available, unavailable images are reset
+	require.NoError(t, remote.Write(srcRef, img))
+	r.checkUpstream(ctx)
+	require.Equal(t, upstreamAvailable, upstreamState())
+	require.Empty(t, recorder.Events)
+	require.Equal(t, 0, testutil.CollectAndCount(upstreamUnavailable))
+
+	//Available -> Deleted
+	require.NoError(t, remote.Delete(srcRef))
+	r.checkUpstream(ctx)
+	require.Equal(t, upstreamDeleted, upstreamState())
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, "UpstreamDeleted")
+	require.Equal(t, 1, testutil.CollectAndCount(upstreamUnavailable))
+	require.Equal(t, float64(1), testutil.ToFloat64(upstreamUnavailable.WithLabelValues(u.Host, upstreamDeleted)))
+
+	//Deleted -> Available
+	require.NoError(t, remote.Write(srcRef, img))
+	r.checkUpstream(ctx)
+	require.Equal(t, upstreamAvailable, upstreamState())
+	require.Empty(t, recorder.Events)
+	require.Equal(t, 0, testutil.CollectAndCount(upstreamUnavailable))
+}
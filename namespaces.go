@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// parseNamespaceSelector parses label selector of namespaces, empty selector is nil
+func parseNamespaceSelector(value string) (labels.Selector, error) {
+	if value == "" {
+		return nil, nil
+	}
+	return labels.Parse(value)
+}
+
+// namespaceLabelsChanged filters namespaces, labels of which were changed
+var namespaceLabelsChanged = predicate.Funcs{
+	CreateFunc: func(event.CreateEvent) bool { return false },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return !reflect.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels())
+	},
+	DeleteFunc:  func(event.DeleteEvent) bool { return false },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// usesNamespaceLabels checks if namespaces are selected by their labels
+func (r *reconciler) usesNamespaceLabels() bool {
+	return r.namespaceSelector != nil || r.ignoreSelector != nil
+}
+
+// namespaceReader returns reader for namespaces: namespaces are cluster scoped, so they are
+// not in namespace scoped cache and are read directly
+func (r *reconciler) namespaceReader() client.Reader {
+	if r.namespaces != nil {
+		return r.namespaces
+	}
+	if r.namespaceScoped {
+		return r.uncachedReader()
+	}
+	return r.client
+}
+
+// namespaceRead is the result of reading a namespace
+type namespaceRead struct {
+	namespace *v1.Namespace
+	err       error
+}
+
+// namespaceOnceReader reads every namespace once, so checks within a single reconcile
+// (see namespaceIgnored and forNamespace) do not repeat requests. Other objects are read through
+type namespaceOnceReader struct {
+	client.Reader
+	read map[string]namespaceRead
+}
+
+// Get reads the namespace, unless it was read already
+func (n *namespaceOnceReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	ns, isNamespace := obj.(*v1.Namespace)
+	if !isNamespace {
+		return n.Reader.Get(ctx, key, obj)
+	}
+	if read, isRead := n.read[key.Name]; isRead {
+		if read.err == nil {
+			read.namespace.DeepCopyInto(ns)
+		}
+		return read.err
+	}
+	err := n.Reader.Get(ctx, key, ns)
+	n.read[key.Name] = namespaceRead{namespace: ns.DeepCopy(), err: err}
+	return err
+}
+
+// readingNamespacesOnce returns reconciler reading every namespace once, to be used within
+// a single reconcile. NOTE! Returned reconciler is a shallow copy
+func (r *reconciler) readingNamespacesOnce() *reconciler {
+	once := *r
+	once.namespaces = &namespaceOnceReader{Reader: r.namespaceReader(), read: map[string]namespaceRead{}}
+	return &once
+}
+
+// namespaceIgnored checks if workloads of the namespace are not managed: namespace is ignored
+// by name, does not match namespaceSelector or matches ignoreSelector
+func (r *reconciler) namespaceIgnored(ctx context.Context, name string) (bool, error) {
+	if _, ignore := r.ignoredNamespaces[name]; ignore {
+		return true, nil
+	}
+	if !r.usesNamespaceLabels() {
+		return false, nil
+	}
+
+	namespace := &v1.Namespace{}
+	if err := r.namespaceReader().Get(ctx, types.NamespacedName{Name: name}, namespace); err != nil {
+		return true, fmt.Errorf("could not get namespace %s: %w", name, err)
+	}
+	set := labels.Set(namespace.Labels)
+	if r.namespaceSelector != nil && !r.namespaceSelector.Matches(set) {
+		return true, nil
+	}
+	return r.ignoreSelector != nil && r.ignoreSelector.Matches(set), nil
+}
+
+// namespaceWorkloads returns map function, that enqueues all workloads of the kind in the namespace,
+// so they are reconciled (or left alone) when labels of the namespace change
+func (r *reconciler) namespaceWorkloads(adapter workloadAdapter) handler.MapFunc {
+	return func(obj client.Object) []reconcile.Request {
+		ctx := context.Background()
+		list := adapter.newList()
+		if err := r.client.List(ctx, list, client.InNamespace(obj.GetName())); err != nil {
+			log.FromContext(ctx).Error(err, "could not list workloads", "kind", adapter.kind(), "namespace", obj.GetName())
+			return nil
+		}
+
+		var requests []reconcile.Request
+		_ = meta.EachListItem(list, func(item runtime.Object) error {
+			if workload, isObject := item.(client.Object); isObject {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Namespace: workload.GetNamespace(), Name: workload.GetName()},
+				})
+			}
+			return nil
+		})
+		return requests
+	}
+}
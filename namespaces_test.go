@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Test_namespaceIgnored checks namespaces are selected by names and labels
+func Test_namespaceIgnored(t *testing.T) {
+	include, err := parseNamespaceSelector("imgclonectrl.io/enabled=true")
+	require.NoError(t, err)
+	exclude, err := parseNamespaceSelector("team in (infra)")
+	require.NoError(t, err)
+
+	r := &reconciler{
+		client: fake.NewClientBuilder().WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: map[string]string{"imgclonectrl.io/enabled": "true"}}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "infra", Labels: map[string]string{"imgclonectrl.io/enabled": "true", "team": "infra"}}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "sandbox"}},
+		).Build(),
+		ignoredNamespaces: map[string]struct{}{"kube-system": {}},
+		namespaceSelector: include,
+		ignoreSelector:    exclude,
+	}
+	ctx := context.Background()
+
+	for namespace, ignored := range map[string]bool{"web": false, "infra": true, "sandbox": true, "kube-system": true} {
+		ignore, err := r.namespaceIgnored(ctx, namespace)
+		require.NoError(t, err)
+		require.Equal(t, ignored, ignore, namespace)
+	}
+	ignore, err := r.namespaceIgnored(ctx, "missing")
+	require.Error(t, err)
+	require.True(t, ignore)
+
+	//without selectors namespaces are not fetched
+	r = &reconciler{client: fake.NewClientBuilder().Build()}
+	ignore, err = r.namespaceIgnored(ctx, "missing")
+	require.NoError(t, err)
+	require.False(t, ignore)
+}
+
+// countingClient counts reads of objects
+type countingClient struct {
+	client.Client
+	gets int
+}
+
+func (c *countingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	c.gets++
+	return c.Client.Get(ctx, key, obj)
+}
+
+// Test_readingNamespacesOnce checks namespace is read once within a reconcile
+func Test_readingNamespacesOnce(t *testing.T) {
+	include, err := parseNamespaceSelector("imgclonectrl.io/enabled=true")
+	require.NoError(t, err)
+	counting := &countingClient{Client: fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"imgclonectrl.io/enabled": "true"},
+			Annotations: map[string]string{backupRegistryAnnotation: "harbor.example.com/team-a/backup"}}},
+	).Build()}
+	r := &reconciler{client: counting, namespaceSelector: include, backupRegistry: "registry.example.com/backup"}
+	ctx := context.Background()
+
+	once := r.readingNamespacesOnce()
+	ignore, err := once.namespaceIgnored(ctx, "team-a")
+	require.NoError(t, err)
+	require.False(t, ignore)
+	tenant, err := once.forNamespace(ctx, "team-a")
+	require.NoError(t, err)
+	require.Equal(t, "harbor.example.com/team-a/backup", tenant.backupRegistry)
+	_, err = once.namespaceIgnored(ctx, "missing")
+	require.Error(t, err)
+	_, err = once.namespaceIgnored(ctx, "missing")
+	require.Error(t, err)
+	require.Equal(t, 2, counting.gets)
+
+	//the next reconcile reads namespaces again
+	_, err = r.readingNamespacesOnce().namespaceIgnored(ctx, "team-a")
+	require.NoError(t, err)
+	require.Equal(t, 3, counting.gets)
+}
+
+// Test_namespaceWorkloads checks workloads of the namespace are enqueued, once its labels change
+func Test_namespaceWorkloads(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web"}}
+	labeled := namespace.DeepCopy()
+	labeled.Labels = map[string]string{"imgclonectrl.io/enabled": "true"}
+	require.True(t, namespaceLabelsChanged.Update(event.UpdateEvent{ObjectOld: namespace, ObjectNew: labeled}))
+	require.False(t, namespaceLabelsChanged.Update(event.UpdateEvent{ObjectOld: labeled, ObjectNew: labeled.DeepCopy()}))
+
+	r := &reconciler{client: fake.NewClientBuilder().WithObjects(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "frontend", Namespace: "web"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "web"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "other"}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "web"}},
+	).Build()}
+
+	requests := r.namespaceWorkloads(workloadKinds["Deployment"])(labeled)
+	require.ElementsMatch(t, []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: "web", Name: "frontend"}},
+		{NamespacedName: types.NamespacedName{Namespace: "web", Name: "api"}},
+	}, requests)
+	require.Equal(t, []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "web", Name: "agent"}}},
+		r.namespaceWorkloads(workloadKinds["DaemonSet"])(labeled))
+}
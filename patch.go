@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// fieldManager is the name controller writes workloads under
+	fieldManager = "imgclonectrl"
+)
+
+// errImagesChanged is returned, when images of the workload changed since they were backed up
+var errImagesChanged = errors.New("images of the workload changed since backup")
+
+// managedAnnotations are annotations of workloads written by the controller
+var managedAnnotations = []string{sourceImagesAnnotation, statusAnnotation, protectedAnnotation,
+	rolloutAnnotation, revertedAnnotation, templateHashAnnotation}
+
+// containerImage is an entry of strategic merge patch, that sets image of the container
+type containerImage struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// containerImages returns entries of strategic merge patch for the containers
+func containerImages(containers []v1.Container) []containerImage {
+	images := make([]containerImage, 0, len(containers))
+	for _, c := range containers {
+		images = append(images, containerImage{Name: c.Name, Image: c.Image})
+	}
+	return images
+}
+
+// imagePatch returns patch, that sets container images and managed annotations of the object
+// to its current values (see workloadAdapter.imagePatch). The patch carries resourceVersion
+// of the object, so it fails with conflict, if the object was changed meanwhile
+func imagePatch(obj client.Object) (types.PatchType, []byte, error) {
+	adapter, err := adapterOf(obj)
+	if err != nil {
+		return "", nil, err
+	}
+
+	annotations := map[string]interface{}{}
+	for _, key := range managedAnnotations {
+		if value, exists := obj.GetAnnotations()[key]; exists {
+			annotations[key] = value
+		} else {
+			annotations[key] = nil //removes annotation
+		}
+	}
+	return adapter.imagePatch(obj, annotations)
+}
+
+// patchImages applies change to the object and writes its images and managed annotations
+// with imagePatch. On conflict (object was changed meanwhile), the object is
+// fetched again and the change is re-applied to it
+func (r *reconciler) patchImages(ctx context.Context, ref workloadRef, obj client.Object, change func(obj client.Object) error) error {
+	first := true
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if !first {
+			fresh, err := r.fetchWorkload(ctx, ref)
+			if err != nil {
+				return err
+			}
+			obj = fresh
+		}
+		first = false
+
+		if err := change(obj); err != nil {
+			return err
+		}
+		patchType, data, err := imagePatch(obj)
+		if err != nil {
+			return err
+		}
+		return r.client.Patch(ctx, obj, client.RawPatch(patchType, data), client.FieldOwner(fieldManager))
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Test_imagePatch checks the patch touches only container images and managed annotations
+func Test_imagePatch(t *testing.T) {
+	obj := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test", ResourceVersion: "42",
+			Annotations: map[string]string{sourceImagesAnnotation: `{"backup:nginx_1.19":"nginx:1.19"}`, "team": "web"}},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{Spec: v1.PodSpec{
+				Containers: []v1.Container{{Name: "nginx", Image: "backup:nginx_1.19", Args: []string{"-g"}}},
+			}},
+		},
+	}
+	replicas := int32(3)
+	obj.Spec.Replicas = &replicas
+
+	patchType, data, err := imagePatch(obj)
+	require.NoError(t, err)
+	require.Equal(t, types.StrategicMergePatchType, patchType)
+	require.JSONEq(t, `{
+		"metadata": {
+			"resourceVersion": "42",
+			"annotations": {
+				"imgclonectrl.io/source-images": "{\"backup:nginx_1.19\":\"nginx:1.19\"}",
+				"imgclonectrl.io/status": null,
+				"imgclonectrl.io/protected": null,
+				"imgclonectrl.io/rewritten-at": null,
+				"imgclonectrl.io/reverted": null,
+				"imgclonectrl.io/template-hash": null
+			}
+		},
+		"spec": {"template": {"spec": {"containers": [{"name": "nginx", "image": "backup:nginx_1.19"}]}}}
+	}`, string(data))
+
+	var patch map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &patch))
+	require.NotContains(t, patch["spec"], "replicas")
+}
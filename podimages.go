@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"reflect"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// podImages returns images of all containers of the pod, including init and ephemeral ones
+func podImages(pod *v1.Pod) map[string]struct{} {
+	images := map[string]struct{}{}
+	for _, c := range pod.Spec.Containers {
+		images[c.Image] = struct{}{}
+	}
+	for _, c := range pod.Spec.InitContainers {
+		images[c.Image] = struct{}{}
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		images[c.Image] = struct{}{}
+	}
+	return images
+}
+
+// podImagesChanged filters pods, that are created or got new images (i.e. ephemeral container
+// was added for debugging), so their workloads are reconciled to back up images missing in templates
+var podImagesChanged = predicate.Funcs{
+	CreateFunc: func(e event.CreateEvent) bool {
+		return metav1.GetControllerOf(e.Object) != nil
+	},
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldPod, isPod := e.ObjectOld.(*v1.Pod)
+		newPod, isNewPod := e.ObjectNew.(*v1.Pod)
+		return isPod && isNewPod && !reflect.DeepEqual(podImages(oldPod), podImages(newPod))
+	},
+	DeleteFunc:  func(event.DeleteEvent) bool { return false },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// ownerKind returns name of the kind of the owner, as used in workload references
+func ownerKind(owner metav1.OwnerReference) string {
+	gv, _ := schema.ParseGroupVersion(owner.APIVersion)
+	if gv.Group == "" || gv.Group == appsv1.GroupName {
+		if _, builtIn := workloadKinds[owner.Kind]; builtIn {
+			return owner.Kind
+		}
+	}
+	return customKind{gvk: gv.WithKind(owner.Kind)}.name()
+}
+
+// ownerOf returns reference to managed workload controlling the pod, either directly
+// (i.e. DaemonSet) or via ReplicaSet (i.e. Deployment, Argo Rollout)
+func (r *reconciler) ownerOf(ctx context.Context, pod *v1.Pod) (workloadRef, bool, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner != nil && owner.Kind == "ReplicaSet" {
+		rs := &appsv1.ReplicaSet{}
+		if err := r.client.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}, rs); err != nil {
+			return workloadRef{}, false, err
+		}
+		owner = metav1.GetControllerOf(rs)
+	}
+	if owner == nil {
+		return workloadRef{}, false, nil
+	}
+
+	kind := ownerKind(*owner)
+	if _, managed := workloadKinds[kind]; !managed {
+		return workloadRef{}, false, nil
+	}
+	return workloadRef{Kind: kind, Namespace: pod.Namespace, Name: owner.Name}, true, nil
+}
+
+// podOwnerRequests returns map function, that enqueues workload of the kind owning the pod
+func (r *reconciler) podOwnerRequests(kind string) handler.MapFunc {
+	return func(obj client.Object) []reconcile.Request {
+		pod, isPod := obj.(*v1.Pod)
+		if !isPod {
+			return nil
+		}
+		ref, managed, err := r.ownerOf(context.Background(), pod)
+		if err != nil || !managed || ref.Kind != kind {
+			return nil
+		}
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}}}
+	}
+}
+
+// podOnlyImages returns images (src -> dst) of pods of the workload, that are not in its pod template:
+// images of ephemeral containers and of sidecars injected by mutating webhooks (i.e. service mesh).
+// Such images are backed up, but never rewritten, as there is nothing to rewrite in the template.
+// Pods of previous ReplicaSets or DaemonSet revisions (rollout in progress) are skipped, as they run
+// previous templates. Workloads without pod selector (i.e. Knative Service) have no pods to check
+func (r *reconciler) podOnlyImages(ctx context.Context, obj client.Object) (map[string]string, error) {
+	podSpec, err := podSpecOf(obj)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := selectorOf(obj)
+	if stderrors.Is(err, errNoSelector) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pods := &v1.PodList{}
+	if err := r.client.List(ctx, pods, client.InNamespace(obj.GetNamespace()), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+
+	known := map[string]struct{}{} //images of the template and upstream images it was rewritten from
+	for image := range podImages(&v1.Pod{Spec: *podSpec}) {
+		known[image] = struct{}{}
+	}
+	sources, _ := sourceImages(obj)
+	for _, src := range sources {
+		known[src] = struct{}{}
+	}
+
+	current, err := r.currentReplicaSet(ctx, obj, pods.Items)
+	if err != nil {
+		return nil, err
+	}
+	currentHash, err := r.currentDaemonSetHash(ctx, obj, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	images := map[string]string{}
+	for i := range pods.Items {
+		//pods of previous ReplicaSets or DaemonSet revisions run images of previous templates, being rolled out
+		if owner := metav1.GetControllerOf(&pods.Items[i]); owner != nil && owner.Kind == "ReplicaSet" && owner.Name != current {
+			continue
+		}
+		if hash, hasHash := pods.Items[i].Labels[appsv1.ControllerRevisionHashLabelKey]; currentHash != "" && hasHash && hash != currentHash {
+			continue
+		}
+		for image := range podImages(&pods.Items[i]) {
+			if _, isKnown := known[image]; isKnown || !r.shouldBackup(image) {
+				continue
+			}
+			images[image] = r.getTargetImage(image)
+		}
+	}
+	return images, nil
+}
+
+// currentReplicaSet returns name of the newest ReplicaSet of the workload (with the highest revision)
+// among ReplicaSets of the pods, empty if pods are not owned by ReplicaSets
+func (r *reconciler) currentReplicaSet(ctx context.Context, obj client.Object, pods []v1.Pod) (string, error) {
+	current, currentRevision := "", int64(-1)
+	seen := map[string]struct{}{}
+	for i := range pods {
+		owner := metav1.GetControllerOf(&pods[i])
+		if owner == nil || owner.Kind != "ReplicaSet" {
+			continue
+		}
+		if _, isSeen := seen[owner.Name]; isSeen {
+			continue
+		}
+		seen[owner.Name] = struct{}{}
+
+		rs := &appsv1.ReplicaSet{}
+		if err := r.client.Get(ctx, types.NamespacedName{Namespace: obj.GetNamespace(), Name: owner.Name}, rs); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return "", err
+		}
+		if rsOwner := metav1.GetControllerOf(rs); rsOwner == nil || rsOwner.Name != obj.GetName() {
+			continue
+		}
+		if revision := replicaSetRevision(rs); revision > currentRevision {
+			current, currentRevision = rs.Name, revision
+		}
+	}
+	return current, nil
+}
+
+// currentDaemonSetHash returns hash of the newest ControllerRevision of DaemonSet (with the highest
+// revision), as set in controller-revision-hash label of its pods. Empty for other kinds or if DaemonSet
+// has no revisions yet
+func (r *reconciler) currentDaemonSetHash(ctx context.Context, obj client.Object, selector labels.Selector) (string, error) {
+	if _, isDaemonSet := obj.(*appsv1.DaemonSet); !isDaemonSet {
+		return "", nil
+	}
+	revisions := &appsv1.ControllerRevisionList{}
+	if err := r.client.List(ctx, revisions, client.InNamespace(obj.GetNamespace()), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return "", err
+	}
+	current, currentRevision := "", int64(-1)
+	for i := range revisions.Items {
+		if owner := metav1.GetControllerOf(&revisions.Items[i]); owner == nil || owner.Name != obj.GetName() {
+			continue
+		}
+		if revisions.Items[i].Revision > currentRevision {
+			current, currentRevision = revisions.Items[i].Labels[appsv1.ControllerRevisionHashLabelKey], revisions.Items[i].Revision
+		}
+	}
+	return current, nil
+}
+
+// replicaSetRevision returns revision of ReplicaSet, set by Deployment (or Argo Rollout) controller
+func replicaSetRevision(rs *appsv1.ReplicaSet) int64 {
+	for _, key := range []string{"deployment.kubernetes.io/revision", "rollout.argoproj.io/revision"} {
+		if revision, err := strconv.ParseInt(rs.Annotations[key], 10, 64); err == nil {
+			return revision
+		}
+	}
+	return 0
+}
+
+// backupPodImages pushes images of pods missing in pod template to backup registry,
+// unless they are backed up already
+func (r *reconciler) backupPodImages(ctx context.Context, images map[string]string) error {
+	missing := map[string]string{}
+	for src, dst := range images {
+		if !r.inventory.isBackedUp(src, dst) {
+			missing[src] = dst
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return r.pushImagesToBackupRegistry(ctx, missing)
+}
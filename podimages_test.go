@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Test_podOnlyImages checks images of injected sidecars and ephemeral containers are found for backup
+func Test_podOnlyImages(t *testing.T) {
+	isController := true
+	labels := map[string]string{"app": "web"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.19"}}},
+			},
+		},
+	}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web-5d4f", Namespace: "test",
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Controller: &isController}}}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-5d4f-x7k2p", Namespace: "test", Labels: labels,
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d4f", Controller: &isController}}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.19"}, {Name: "istio-proxy", Image: "istio/proxyv2:1.9.0"}},
+		},
+	}
+	r := &reconciler{
+		client:         fake.NewClientBuilder().WithObjects(deployment, replicaSet, pod).Build(),
+		backupRegistry: "backup.local/backup",
+	}
+	ctx := context.Background()
+
+	images, err := r.podOnlyImages(ctx, deployment)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"istio/proxyv2:1.9.0": r.getTargetImage("istio/proxyv2:1.9.0")}, images)
+
+	//debugging container is added
+	debugged := pod.DeepCopy()
+	debugged.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "busybox:1.33"},
+	}}
+	require.True(t, podImagesChanged.Update(event.UpdateEvent{ObjectOld: pod, ObjectNew: debugged}))
+	require.False(t, podImagesChanged.Update(event.UpdateEvent{ObjectOld: pod, ObjectNew: pod.DeepCopy()}))
+	require.NoError(t, r.client.Update(ctx, debugged))
+
+	images, err = r.podOnlyImages(ctx, deployment)
+	require.NoError(t, err)
+	require.Contains(t, images, "busybox:1.33")
+	require.Len(t, images, 2)
+
+	//pods of the previous ReplicaSet are skipped during rollout
+	previous := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web-7c9b", Namespace: "test",
+		Annotations:     map[string]string{"deployment.kubernetes.io/revision": "1"},
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Controller: &isController}}}}
+	replicaSet.Annotations = map[string]string{"deployment.kubernetes.io/revision": "2"}
+	require.NoError(t, r.client.Update(ctx, replicaSet))
+	oldPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-7c9b-q2w3e", Namespace: "test", Labels: labels,
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-7c9b", Controller: &isController}}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.18"}}},
+	}
+	require.NoError(t, r.client.Create(ctx, previous))
+	require.NoError(t, r.client.Create(ctx, oldPod))
+	images, err = r.podOnlyImages(ctx, deployment)
+	require.NoError(t, err)
+	require.NotContains(t, images, "nginx:1.18")
+	require.Len(t, images, 2)
+
+	//pod enqueues the owning Deployment only
+	require.Equal(t, []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "test", Name: "web"}}},
+		r.podOwnerRequests("Deployment")(pod))
+	require.Empty(t, r.podOwnerRequests("DaemonSet")(pod))
+}
+
+// Test_podOnlyImagesDaemonSet checks pods of previous DaemonSet revisions are skipped
+func Test_podOnlyImagesDaemonSet(t *testing.T) {
+	isController := true
+	labels := map[string]string{"app": "agent"}
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "test"},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "agent", Image: "fluentd:1.12"}}},
+			},
+		},
+	}
+	owner := []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "agent", Controller: &isController}}
+	revision := func(hash string, number int64) *appsv1.ControllerRevision {
+		return &appsv1.ControllerRevision{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent-" + hash, Namespace: "test", OwnerReferences: owner,
+				Labels: map[string]string{"app": "agent", appsv1.ControllerRevisionHashLabelKey: hash}},
+			Revision: number,
+		}
+	}
+	pod := func(name, hash, image string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test", OwnerReferences: owner,
+				Labels: map[string]string{"app": "agent", appsv1.ControllerRevisionHashLabelKey: hash}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "agent", Image: image}}},
+		}
+	}
+	r := &reconciler{
+		client: fake.NewClientBuilder().WithObjects(daemonSet, revision("6d8f", 1), revision("84c7", 2),
+			pod("agent-x7k2p", "6d8f", "fluentd:1.11"), pod("agent-q2w3e", "84c7", "fluentd:1.12"),
+			pod("agent-z9v8b", "84c7", "debug/agent:1.0")).Build(),
+		backupRegistry: "backup.local/backup",
+	}
+
+	images, err := r.podOnlyImages(context.Background(), daemonSet)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"debug/agent:1.0": r.getTargetImage("debug/agent:1.0")}, images)
+}
+
+// Test_podOnlyImagesNoSelector checks workloads of custom kinds without selector have no pods to check
+func Test_podOnlyImagesNoSelector(t *testing.T) {
+	k, err := parseCustomKind("serving.knative.dev/v1/Service=spec.template.spec")
+	require.NoError(t, err)
+	registerCustomKind(k)
+	defer delete(workloadKinds, k.name())
+
+	u := k.newObject().(*unstructured.Unstructured)
+	u.SetName("web")
+	u.SetNamespace("test")
+	require.NoError(t, unstructured.SetNestedSlice(u.Object, []interface{}{
+		map[string]interface{}{"name": "web", "image": "nginx:1.19"},
+	}, "spec", "template", "spec", "containers"))
+
+	r := &reconciler{client: fake.NewClientBuilder().Build(), backupRegistry: "backup.local/backup"}
+	images, err := r.podOnlyImages(context.Background(), u)
+	require.NoError(t, err)
+	require.Empty(t, images)
+}
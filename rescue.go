@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// podRescueOff - pods failing to pull images are not watched
+	podRescueOff = "off"
+	// podRescueEvent - event pointing at the backup image is recorded on the pod
+	podRescueEvent = "event"
+	// podRescuePatch - workload owning the pod is switched to the backup image
+	// (event is recorded for pods not owned by managed workloads)
+	podRescuePatch = "patch"
+)
+
+// pullFailing filters pods, that could not pull some of their images
+var pullFailing = predicate.NewPredicateFuncs(func(obj client.Object) bool {
+	pod, isPod := obj.(*v1.Pod)
+	return isPod && len(pullFailingContainers(pod)) != 0
+})
+
+// podRescuer reconciles pods, that could not pull upstream images, which are backed up
+type podRescuer struct {
+	r      *reconciler
+	policy string //what to do with pods (event, patch)
+}
+
+// Implement reconcile.Reconciler so the controller can reconcile pods
+var _ reconcile.Reconciler = &podRescuer{}
+
+// ownerWorkload returns managed workload owning the pod (see reconciler.ownerOf)
+func (p *podRescuer) ownerWorkload(ctx context.Context, pod *v1.Pod) (client.Object, error) {
+	ref, managed, err := p.r.ownerOf(ctx, pod)
+	if err != nil || !managed {
+		return nil, err
+	}
+	return p.r.fetchWorkload(ctx, ref)
+}
+
+// Reconcile finds containers of the pod failing to pull upstream images, that are backed up,
+// and either points at the backups with an event, or switches the owning workload to them
+func (p *podRescuer) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	lg := log.FromContext(ctx)
+	if !p.r.shards.owns(request.Namespace) {
+		return reconcile.Result{}, nil
+	}
+	r := p.r.readingNamespacesOnce()
+	if ignore, err := r.namespaceIgnored(ctx, request.Namespace); ignore {
+		return reconcile.Result{}, err
+	}
+
+	pod := &v1.Pod{}
+	if err := p.r.client.Get(ctx, request.NamespacedName, pod); err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	//Backups are looked up in backup registry of the namespace
+	tenant, err := r.forNamespace(ctx, request.Namespace)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if tenant.registryFallback != "" {
+		p.r.event(pod, v1.EventTypeWarning, "DefaultBackupRegistry", tenant.registryFallback)
+	}
+	rescue := map[string]string{} //upstream image -> backup image
+	for _, c := range pullFailingContainers(pod) {
+		if dst := tenant.getTargetImage(c.Image); p.r.inventory.isBackedUp(c.Image, dst) {
+			rescue[c.Image] = dst
+		}
+	}
+	if len(rescue) == 0 {
+		return reconcile.Result{}, nil
+	}
+
+	if p.policy == podRescuePatch {
+		workload, err := p.ownerWorkload(ctx, pod)
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("could not get owner of pod: %w", err)
+		}
+		if workload != nil {
+			return p.patchWorkload(ctx, pod, workload, rescue)
+		}
+	}
+
+	for src, dst := range rescue {
+		lg.Info(fmt.Sprintf("pod could not pull %q, backup is available as %q", src, dst))
+		p.r.event(pod, v1.EventTypeWarning, "BackupAvailable",
+			fmt.Sprintf("could not pull image %q, its backup is available as %q", src, dst))
+	}
+	return reconcile.Result{}, nil
+}
+
+// patchWorkload switches workload owning the pod to backup images. Like other rewrites, it's
+// limited by rewrite budget, and rollout of backup images is watched (see watchRollout)
+func (p *podRescuer) patchWorkload(ctx context.Context, pod *v1.Pod, workload client.Object, rescue map[string]string) (reconcile.Result, error) {
+	ref := workloadOf(workload)
+	if wait, reason := p.r.rewriteBudget.take(ref.Namespace); wait > 0 {
+		log.FromContext(ctx).Info(fmt.Sprintf("rescue deferred for %s: %s", wait.Round(time.Second), reason), "workload", ref.String())
+		return reconcile.Result{RequeueAfter: wait}, nil
+	}
+
+	err := p.r.patchImages(ctx, ref, workload, func(obj client.Object) error {
+		if err := rewriteWorkloadImages(obj, rescue); err != nil {
+			return err
+		}
+
+		sources, _ := sourceImages(obj)
+		for src, dst := range rescue {
+			sources[dst] = src
+		}
+		setSourceImages(obj, sources)
+		setConditions(obj, condition(conditionSpecRewritten, true, "Rescued", "pods could not pull upstream images"))
+		if p.r.rolloutWatched(obj) { //rollout is watched, once the workload is reconciled
+			annotations := obj.GetAnnotations()
+			annotations[rolloutAnnotation] = time.Now().UTC().Format(time.RFC3339)
+			obj.SetAnnotations(annotations)
+		}
+		return nil
+	})
+	if err != nil {
+		p.r.rewriteBudget.refund(ref.Namespace)
+		return reconcile.Result{}, fmt.Errorf("could not switch %s to backup images: %w", ref.String(), err)
+	}
+
+	for src, dst := range rescue {
+		message := fmt.Sprintf("pod %s could not pull image %q, switched to its backup %q", pod.Name, src, dst)
+		log.FromContext(ctx).Info(message, "workload", ref.String())
+		p.r.event(workload, v1.EventTypeWarning, "Rescued", message)
+		p.r.event(pod, v1.EventTypeWarning, "Rescued", fmt.Sprintf("%s %s", ref.String(), message))
+	}
+	return reconcile.Result{}, nil
+}
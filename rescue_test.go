@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Test_podRescuer checks workload owning the pod failing to pull backed up image is switched to the backup
+func Test_podRescuer(t *testing.T) {
+	isController := true
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.19"}}},
+			},
+		},
+	}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web-5d4f", Namespace: "test",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "web", Controller: &isController}}}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-5d4f-x7k2p", Namespace: "test",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-5d4f", Controller: &isController}}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.19"}}},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{Name: "nginx",
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}}}},
+	}
+	require.True(t, pullFailing.Generic(event.GenericEvent{Object: pod}))
+
+	inv := newInventory()
+	inv.recordBackup("nginx:1.19", "backup.local/backup:nginx_1.19", "sha256:aaa")
+	r := &reconciler{
+		client:         fake.NewClientBuilder().WithObjects(deployment, replicaSet, pod).Build(),
+		backupRegistry: "backup.local/backup",
+		inventory:      inv,
+	}
+	ctx := context.Background()
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: pod.Name}}
+	key := types.NamespacedName{Namespace: "test", Name: "web"}
+
+	//event only
+	_, err := (&podRescuer{r: r, policy: podRescueEvent}).Reconcile(ctx, request)
+	require.NoError(t, err)
+	current := &appsv1.Deployment{}
+	require.NoError(t, r.client.Get(ctx, key, current))
+	require.Equal(t, "nginx:1.19", current.Spec.Template.Spec.Containers[0].Image)
+
+	//rewrite budget is exhausted
+	r.rewriteBudget = newRewriteBudget(time.Hour, 1, 0, nil)
+	r.rolloutDeadline = time.Minute
+	wait, _ := r.rewriteBudget.take("other")
+	require.Zero(t, wait)
+	result, err := (&podRescuer{r: r, policy: podRescuePatch}).Reconcile(ctx, request)
+	require.NoError(t, err)
+	require.True(t, result.RequeueAfter > 0)
+	require.NoError(t, r.client.Get(ctx, key, current))
+	require.Equal(t, "nginx:1.19", current.Spec.Template.Spec.Containers[0].Image)
+
+	//backup is looked up in backup registry of the namespace
+	tenantNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test",
+		Annotations: map[string]string{backupRegistryAnnotation: "harbor.example.com/test/backup"}}}
+	require.NoError(t, r.client.Create(ctx, tenantNamespace))
+	r.rewriteBudget.refund("other")
+	_, err = (&podRescuer{r: r, policy: podRescuePatch}).Reconcile(ctx, request)
+	require.NoError(t, err)
+	require.NoError(t, r.client.Get(ctx, key, current))
+	require.Equal(t, "nginx:1.19", current.Spec.Template.Spec.Containers[0].Image, "not backed up to registry of namespace")
+	require.NoError(t, r.client.Delete(ctx, tenantNamespace))
+
+	_, err = (&podRescuer{r: r, policy: podRescuePatch}).Reconcile(ctx, request)
+	require.NoError(t, err)
+	require.NoError(t, r.client.Get(ctx, key, current))
+	require.Equal(t, "backup.local/backup:nginx_1.19", current.Spec.Template.Spec.Containers[0].Image)
+	require.Contains(t, current.Annotations, rolloutAnnotation, "rollout is watched")
+	sources, err := sourceImages(current)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"backup.local/backup:nginx_1.19": "nginx:1.19"}, sources)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// rolloutAnnotation holds time the workload was rewritten to use backup images,
+	// while rollout of backup images is watched
+	rolloutAnnotation = "imgclonectrl.io/rewritten-at"
+	// revertedAnnotation holds the reason the workload was reverted to upstream images.
+	// Reverted workloads are not rewritten again, until the annotation is removed
+	revertedAnnotation = "imgclonectrl.io/reverted"
+)
+
+// pullFailureReasons are reasons of waiting containers, that could not pull the image
+var pullFailureReasons = map[string]struct{}{"ErrImagePull": {}, "ImagePullBackOff": {}}
+
+// pullFailingContainers returns containers of the pod, that could not pull their images
+func pullFailingContainers(pod *v1.Pod) []v1.Container {
+	specs := map[string]v1.Container{} //container name -> spec
+	for _, c := range append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		specs[c.Name] = c
+	}
+
+	var failing []v1.Container
+	for _, status := range append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...) {
+		if status.State.Waiting == nil {
+			continue
+		}
+		if _, failed := pullFailureReasons[status.State.Waiting.Reason]; !failed {
+			continue
+		}
+		if spec, exists := specs[status.Name]; exists {
+			failing = append(failing, spec)
+		}
+	}
+	return failing
+}
+
+// pullFailures returns descriptions of containers of the pods, that could not pull the images
+func pullFailures(pods []v1.Pod, images map[string]string) []string {
+	var failures []string
+	for i := range pods {
+		for _, c := range pullFailingContainers(&pods[i]) {
+			if _, backup := images[c.Image]; !backup {
+				continue
+			}
+			failures = append(failures, fmt.Sprintf("%s/%s: could not pull %s", pods[i].Name, c.Name, c.Image))
+		}
+	}
+	return failures
+}
+
+// rolloutWatched checks if rollout of the object is watched once it's rewritten: status of
+// custom kinds is not known, so their rollouts are not watched
+func (r *reconciler) rolloutWatched(obj client.Object) bool {
+	if r.rolloutDeadline <= 0 {
+		return false
+	}
+	adapter, err := adapterOf(obj)
+	if err != nil {
+		return false
+	}
+	_, custom := adapter.(customKind)
+	return !custom
+}
+
+// watchRollout watches rollout of the workload rewritten to use backup images. If pods can't
+// pull backup images within rolloutDeadline, the workload is reverted to upstream images.
+// Rollout is checked every rolloutCheckInterval, until it's complete
+func (r *reconciler) watchRollout(ctx context.Context, ref workloadRef, obj client.Object) (reconcile.Result, error) {
+	lg := log.FromContext(ctx)
+	checkLater := reconcile.Result{RequeueAfter: r.rolloutCheckInterval}
+
+	value, watched := obj.GetAnnotations()[rolloutAnnotation]
+	if !watched {
+		return reconcile.Result{}, nil
+	}
+	rewrittenAt, err := time.Parse(time.RFC3339, value)
+	if err != nil || rolloutComplete(obj) {
+		lg.Info("rollout of backup images is complete")
+		return reconcile.Result{}, r.patchAnnotation(ctx, obj, rolloutAnnotation, nil)
+	}
+
+	sources, _ := sourceImages(obj)
+	selector, err := selectorOf(obj)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	pods := &v1.PodList{}
+	if err := r.uncachedReader().List(ctx, pods, client.InNamespace(obj.GetNamespace()), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		lg.Error(err, "could not list pods")
+		return checkLater, nil
+	}
+
+	failures := pullFailures(pods.Items, sources)
+	if len(failures) == 0 || time.Since(rewrittenAt) < r.rolloutDeadline {
+		return checkLater, nil
+	}
+
+	message := fmt.Sprintf("pods could not pull backup images within %s: %s", r.rolloutDeadline, strings.Join(failures, ", "))
+	lg.Info("reverting to upstream images, " + message)
+	err = r.patchImages(ctx, ref, obj, func(obj client.Object) error {
+		sources, _ := sourceImages(obj)
+		if err := rewriteWorkloadImages(obj, sources); err != nil {
+			return err
+		}
+		setSourceImages(obj, nil)
+
+		annotations := obj.GetAnnotations()
+		delete(annotations, rolloutAnnotation)
+		annotations[revertedAnnotation] = fmt.Sprintf("%s: %s", time.Now().UTC().Format(time.RFC3339), message)
+		obj.SetAnnotations(annotations)
+
+		setConditions(obj, condition(conditionSpecRewritten, false, "RolloutFailed", message))
+		return nil
+	})
+	if err != nil {
+		return r.retryLater(ctx, ref, obj, fmt.Errorf("could not revert %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, err)), nil
+	}
+
+	r.event(obj, v1.EventTypeWarning, "RolloutFailed", "reverted to upstream images, "+message)
+	return reconcile.Result{}, nil
+}
+
+// patchAnnotation sets (or removes, if value is nil) annotation of the object with merge patch
+func (r *reconciler) patchAnnotation(ctx context.Context, obj client.Object, key string, value *string) error {
+	base := obj.DeepCopyObject().(client.Object)
+	annotations := obj.GetAnnotations()
+	if value == nil {
+		delete(annotations, key)
+	} else {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key] = *value
+	}
+	obj.SetAnnotations(annotations)
+	return r.client.Patch(ctx, obj, client.MergeFrom(base), client.FieldOwner(fieldManager))
+}
+
+// uncachedReader returns reader for pods and secrets: uncached API reader if set,
+// so fresh objects are read and secrets are not cached cluster wide
+func (r *reconciler) uncachedReader() client.Reader {
+	if r.apiReader != nil {
+		return r.apiReader
+	}
+	return r.client
+}
+
+// reconcileReverted processes workload reverted to upstream images: images are backed up,
+// but the spec is not rewritten, until revertedAnnotation is removed
+func (r *reconciler) reconcileReverted(ctx context.Context, ref workloadRef, obj client.Object) (reconcile.Result, error) {
+	podSpec, err := podSpecOf(obj)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if imageSrcDst := r.imagesToBackup(podSpec); len(imageSrcDst) != 0 {
+		if err := r.pushImagesToBackupRegistry(ctx, imageSrcDst); err != nil {
+			err = fmt.Errorf("could not push images to remote registry: %w", err)
+			r.backupFailed(ctx, obj, err)
+			return r.retryLater(ctx, ref, obj, err), nil
+		}
+	}
+
+	if err := r.patchConditions(ctx, obj,
+		condition(conditionImagesBackedUp, true, "BackedUp", "all images are in backup registry"),
+		condition(conditionBackupFailed, false, "BackedUp", "")); err != nil {
+		log.FromContext(ctx).Error(err, "could not write status")
+	}
+	r.backoff.reset(ref)
+	return reconcile.Result{}, nil
+}
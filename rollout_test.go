@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Test_pullFailures checks only failures to pull backup images are reported
+func Test_pullFailures(t *testing.T) {
+	waiting := func(reason string) v1.ContainerState {
+		return v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: reason}}
+	}
+	pods := []v1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-1"},
+			Spec: v1.PodSpec{Containers: []v1.Container{
+				{Name: "nginx", Image: "backup:nginx_1.19"},
+				{Name: "sidecar", Image: "envoy:1.17"},
+			}},
+			Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{
+				{Name: "nginx", State: waiting("ImagePullBackOff")},
+				{Name: "sidecar", State: waiting("ErrImagePull")}, //upstream image
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-2"},
+			Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "nginx", Image: "backup:nginx_1.19"}}},
+			Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{
+				{Name: "nginx", State: waiting("ContainerCreating")},
+			}},
+		},
+	}
+
+	failures := pullFailures(pods, map[string]string{"backup:nginx_1.19": "nginx:1.19"})
+	require.Equal(t, []string{"web-1/nginx: could not pull backup:nginx_1.19"}, failures)
+}
+
+// Test_watchRollout checks workload, pods of which could not pull backup images within
+// rollout deadline, is reverted to upstream images
+func Test_watchRollout(t *testing.T) {
+	labels := map[string]string{"app": "web"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test", Generation: 2},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "nginx", Image: "backup.local/backup:nginx_1.19"}}},
+			},
+		},
+	}
+	setSourceImages(deployment, map[string]string{"backup.local/backup:nginx_1.19": "nginx:1.19"})
+	deployment.Annotations[rolloutAnnotation] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-5d4f-x7k2p", Namespace: "test", Labels: labels},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "nginx", Image: "backup.local/backup:nginx_1.19"}}},
+		Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{Name: "nginx",
+			State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}}}},
+	}
+	recorder := record.NewFakeRecorder(10)
+	r := &reconciler{
+		client:               fake.NewClientBuilder().WithObjects(deployment, pod).Build(),
+		backupRegistry:       "backup.local/backup",
+		rolloutDeadline:      5 * time.Minute,
+		rolloutCheckInterval: 15 * time.Second,
+		recorder:             recorder,
+	}
+	ctx := context.Background()
+	ref := workloadRef{Kind: "Deployment", Namespace: "test", Name: "web"}
+	key := types.NamespacedName{Namespace: "test", Name: "web"}
+
+	//pods are given time to pull backup images
+	current := &appsv1.Deployment{}
+	require.NoError(t, r.client.Get(ctx, key, current))
+	result, err := r.watchRollout(ctx, ref, current)
+	require.NoError(t, err)
+	require.Equal(t, r.rolloutCheckInterval, result.RequeueAfter)
+	require.Empty(t, recorder.Events)
+
+	//deadline is over
+	r.rolloutDeadline = 30 * time.Second
+	_, err = r.watchRollout(ctx, ref, current)
+	require.NoError(t, err)
+	require.NoError(t, r.client.Get(ctx, key, current))
+	require.Equal(t, "nginx:1.19", current.Spec.Template.Spec.Containers[0].Image)
+	require.NotContains(t, current.Annotations, rolloutAnnotation)
+	require.Contains(t, current.Annotations[revertedAnnotation], "could not pull backup.local/backup:nginx_1.19")
+	rewritten := meta.FindStatusCondition(conditionsOf(current), conditionSpecRewritten)
+	require.NotNil(t, rewritten)
+	require.Equal(t, metav1.ConditionFalse, rewritten.Status)
+	require.Equal(t, "RolloutFailed", rewritten.Reason)
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, "RolloutFailed")
+
+	//reverted workload is not rewritten again
+	_, err = r.forKind(workloadKinds["Deployment"]).Reconcile(ctx, reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	require.NoError(t, r.client.Get(ctx, key, current))
+	require.Equal(t, "nginx:1.19", current.Spec.Template.Spec.Containers[0].Image)
+
+	//rollout of custom kinds is not watched
+	require.True(t, r.rolloutWatched(current))
+	require.False(t, r.rolloutWatched(&unstructured.Unstructured{}))
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+const (
+	// shardGroupLabel of shard Lease names group of replicas sharing namespaces (leader election ID)
+	shardGroupLabel = "imgclonectrl.io/shard-group"
+	// shardVirtualNodes is the number of points of every replica on the hash ring,
+	// so namespaces are split evenly
+	shardVirtualNodes = 64
+)
+
+// hashOf returns 32 bit hash of the value
+func hashOf(value string) uint32 {
+	sum := sha256.Sum256([]byte(value))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// hashRing maps keys to members with consistent hashing: once a member joins or leaves,
+// only keys next to its points move, other keys keep their owners
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string //point -> member
+}
+
+// newHashRing places members on the ring. Members are expected to be sorted,
+// so every replica builds the same ring
+func newHashRing(members []string) *hashRing {
+	ring := &hashRing{owners: map[uint32]string{}}
+	for _, member := range members {
+		for i := 0; i < shardVirtualNodes; i++ {
+			point := hashOf(member + "#" + strconv.Itoa(i))
+			if _, taken := ring.owners[point]; taken {
+				continue
+			}
+			ring.owners[point] = member
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// owner returns member owning the key (the first point clockwise), empty if there are no members
+func (h *hashRing) owner(key string) string {
+	if len(h.points) == 0 {
+		return ""
+	}
+	point := hashOf(key)
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= point })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]]
+}
+
+// shardMembership splits namespaces between replicas. Every replica holds a Lease (labeled with
+// shard group) in election namespace and keeps renewing it, replicas with valid Leases are placed
+// on the hash ring, and namespace is reconciled by the replica owning it on the ring.
+// NOTE! Replicas see membership changes within the renew interval (a third of lease duration),
+// meanwhile a moving namespace may be reconciled by both of them (copies are idempotent).
+// Replica, that could not renew its Lease for lease duration, owns nothing, since other
+// replicas consider it gone
+type shardMembership struct {
+	client        client.Client
+	reader        client.Reader //direct reader, so Leases are not cached
+	namespace     string
+	group         string
+	identity      string
+	leaseDuration time.Duration
+	onChange      func(ctx context.Context) //called once membership changes, apart from renewal (see Start)
+	now           func() time.Time
+
+	mu      sync.RWMutex
+	members []string
+	ring    *hashRing
+	renewed time.Time //the last successful renewal of the Lease
+}
+
+var (
+	_ manager.Runnable               = &shardMembership{}
+	_ manager.LeaderElectionRunnable = &shardMembership{}
+)
+
+func newShardMembership(c client.Client, reader client.Reader, namespace, group, identity string, leaseDuration time.Duration) *shardMembership {
+	return &shardMembership{
+		client:        c,
+		reader:        reader,
+		namespace:     namespace,
+		group:         group,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		now:           time.Now,
+	}
+}
+
+// owns checks if the namespace is in the shard of this replica. Nil membership (no sharding)
+// owns every namespace, replica, which has not joined (or has lost its Lease), owns none
+func (s *shardMembership) owns(namespace string) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.ring == nil || s.now().Sub(s.renewed) >= s.leaseDuration {
+		return false
+	}
+	return s.ring.owner(namespace) == s.identity
+}
+
+// ownsBackup checks if the backup is used by workloads in the shard of this replica, so it's monitored,
+// verified and persisted by this replica. Nil membership owns every backup (including unused ones)
+func (s *shardMembership) ownsBackup(record backupRecord) bool {
+	if s == nil {
+		return true
+	}
+	for w := range record.Workloads {
+		if s.owns(w.Namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// leaseName returns name of the Lease of this replica
+func (s *shardMembership) leaseName() string {
+	return s.group + "-" + s.identity
+}
+
+// renew creates or renews the Lease of this replica
+func (s *shardMembership) renew(ctx context.Context) error {
+	now := metav1.NewMicroTime(s.now())
+	seconds := int32(s.leaseDuration / time.Second)
+
+	lease := &coordinationv1.Lease{}
+	err := s.reader.Get(ctx, types.NamespacedName{Namespace: s.namespace, Name: s.leaseName()}, lease)
+	if errors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.leaseName(),
+				Namespace: s.namespace,
+				Labels:    map[string]string{shardGroupLabel: s.group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		return s.client.Create(ctx, lease)
+	} else if err != nil {
+		return err
+	}
+
+	lease.Spec.HolderIdentity = &s.identity
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &now
+	return s.client.Update(ctx, lease)
+}
+
+// liveMembers returns sorted identities of replicas holding valid Leases
+func (s *shardMembership) liveMembers(ctx context.Context) ([]string, error) {
+	leases := &coordinationv1.LeaseList{}
+	if err := s.reader.List(ctx, leases, client.InNamespace(s.namespace), client.MatchingLabels{shardGroupLabel: s.group}); err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	members := []string{}
+	for _, lease := range leases.Items {
+		spec := lease.Spec
+		if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		if now.Sub(spec.RenewTime.Time) >= time.Duration(*spec.LeaseDurationSeconds)*time.Second {
+			continue
+		}
+		members = append(members, *spec.HolderIdentity)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// sync renews the Lease of this replica and rebuilds the hash ring, if members have changed
+func (s *shardMembership) sync(ctx context.Context) (bool, error) {
+	if err := s.renew(ctx); err != nil {
+		return false, fmt.Errorf("could not renew shard lease: %w", err)
+	}
+	renewed := s.now()
+	members, err := s.liveMembers(ctx)
+	if err != nil {
+		return false, fmt.Errorf("could not list shard leases: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renewed = renewed
+	if s.ring != nil && reflect.DeepEqual(members, s.members) {
+		return false, nil
+	}
+	s.members = members
+	s.ring = newHashRing(members)
+	return true, nil
+}
+
+// leave deletes the Lease of this replica, so its namespaces move to other replicas
+// without waiting for the Lease to expire
+func (s *shardMembership) leave(ctx context.Context) error {
+	s.mu.Lock()
+	s.ring, s.members = nil, nil
+	s.mu.Unlock()
+
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.leaseName()}}
+	if err := s.client.Delete(ctx, lease); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Start joins shards and keeps the Lease renewed until context is done, then leaves.
+// onChange runs in a goroutine of its own, so renewal never waits for it (i.e. for cache sync
+// or enqueueing of workloads); changes made while it's running are coalesced into one more call
+func (s *shardMembership) Start(ctx context.Context) error {
+	lg := log.FromContext(ctx).WithName("shards")
+	lg.Info("joining shards", "identity", s.identity, "group", s.group)
+
+	ticker := time.NewTicker(s.leaseDuration / 3)
+	defer ticker.Stop()
+
+	changes := make(chan struct{}, 1)
+	if s.onChange != nil {
+		go func() {
+			for {
+				select {
+				case <-changes:
+					s.onChange(log.IntoContext(ctx, lg))
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		changed, err := s.sync(ctx)
+		if err != nil {
+			lg.Error(err, "could not sync shard membership")
+		}
+		if changed {
+			s.mu.RLock()
+			members := s.members
+			s.mu.RUnlock()
+			lg.Info("shard members changed", "members", strings.Join(members, ","))
+			shardMembers.Set(float64(len(members)))
+			select {
+			case changes <- struct{}{}:
+			default: //onChange is pending already
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			leaveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := s.leave(leaveCtx); err != nil {
+				lg.Error(err, "could not delete shard lease")
+			}
+			return nil
+		}
+	}
+}
+
+// NeedLeaderElection makes membership to run on every replica
+func (s *shardMembership) NeedLeaderElection() bool {
+	return false
+}
+
+// shardWorkloads sends workloads of the kind in the shard of this replica to events,
+// so they are reconciled once their namespaces move to this replica
+func (r *reconciler) shardWorkloads(ctx context.Context, adapter workloadAdapter, events chan<- event.GenericEvent) {
+	list := adapter.newList()
+	if err := r.client.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "could not list workloads", "kind", adapter.kind())
+		return
+	}
+
+	_ = meta.EachListItem(list, func(item runtime.Object) error {
+		workload, isObject := item.(client.Object)
+		if !isObject || !r.shards.owns(workload.GetNamespace()) {
+			return nil
+		}
+		select {
+		case events <- event.GenericEvent{Object: workload}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// everyReplica runs the runnable on every replica, not on the leader only
+type everyReplica struct {
+	manager.Runnable
+}
+
+// NeedLeaderElection makes the runnable to run on every replica
+func (everyReplica) NeedLeaderElection() bool {
+	return false
+}
+
+// everyReplicaManager adds runnables (controllers) to the manager, so they run on every replica:
+// with sharding replicas reconcile their own shards instead of waiting for leadership
+type everyReplicaManager struct {
+	manager.Manager
+}
+
+// Add adds the runnable to run on every replica
+func (m everyReplicaManager) Add(r manager.Runnable) error {
+	return m.Manager.Add(everyReplica{r})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	imgv1alpha1 "github.com/i-prudnikov/imgCloneCtrl/api/v1alpha1"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// Test_hashRing checks namespaces are split between all members, and only namespaces
+// of the joining member move
+func Test_hashRing(t *testing.T) {
+	require.Equal(t, "", newHashRing(nil).owner("web"))
+
+	before := newHashRing([]string{"ctrl-0", "ctrl-1"})
+	after := newHashRing([]string{"ctrl-0", "ctrl-1", "ctrl-2"})
+
+	owned := map[string]int{}
+	for i := 0; i < 300; i++ {
+		namespace := fmt.Sprintf("team-%d", i)
+		owner := after.owner(namespace)
+		owned[owner]++
+		if owner != "ctrl-2" {
+			require.Equal(t, before.owner(namespace), owner, namespace)
+		}
+	}
+	require.Len(t, owned, 3)
+	for member, count := range owned {
+		require.True(t, count > 50, "%s owns %d namespaces", member, count)
+	}
+}
+
+// Test_shardMembership checks replicas join with Leases, and expired Leases are not members
+func Test_shardMembership(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	seconds := int32(15)
+	renewed := metav1.NewMicroTime(now.Add(-5 * time.Second))
+	expired := metav1.NewMicroTime(now.Add(-time.Minute))
+	lease := func(identity string, renewTime *metav1.MicroTime) *coordinationv1.Lease {
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: "ctrl-" + identity, Namespace: "test-ki", Labels: map[string]string{shardGroupLabel: "ctrl"}},
+			Spec:       coordinationv1.LeaseSpec{HolderIdentity: &identity, LeaseDurationSeconds: &seconds, RenewTime: renewTime},
+		}
+	}
+	c := fake.NewClientBuilder().WithObjects(lease("ctrl-1", &renewed), lease("ctrl-2", &expired)).Build()
+	s := newShardMembership(c, c, "test-ki", "ctrl", "ctrl-0", 15*time.Second)
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	require.False(t, s.owns("web"), "replica owns nothing before it joins")
+
+	changed, err := s.sync(ctx)
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, []string{"ctrl-0", "ctrl-1"}, s.members)
+	for _, namespace := range []string{"web", "api", "infra", "team-a", "team-b"} {
+		require.Equal(t, s.ring.owner(namespace) == "ctrl-0", s.owns(namespace), namespace)
+	}
+
+	changed, err = s.sync(ctx)
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	//replica, that could not renew its Lease, owns nothing
+	now = now.Add(time.Minute)
+	for _, namespace := range []string{"web", "api", "infra", "team-a", "team-b"} {
+		require.False(t, s.owns(namespace), namespace)
+	}
+
+	require.NoError(t, s.leave(ctx))
+	members, err := s.liveMembers(ctx)
+	require.NoError(t, err)
+	require.Empty(t, members)
+
+	require.True(t, (*shardMembership)(nil).owns("web"), "without sharding every namespace is owned")
+}
+
+// Test_shardWorkloads checks only workloads of the shard are enqueued
+func Test_shardWorkloads(t *testing.T) {
+	identity := "ctrl-0"
+	c := fake.NewClientBuilder().WithObjects(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "frontend", Namespace: "web"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "api"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "infra"}},
+	).Build()
+	s := newShardMembership(c, c, "test-ki", "ctrl", identity, 15*time.Second)
+	s.members = []string{"ctrl-0", "ctrl-1"}
+	s.ring = newHashRing(s.members)
+	s.renewed = time.Now()
+	r := &reconciler{client: c, shards: s}
+
+	events := make(chan event.GenericEvent, 3)
+	r.shardWorkloads(context.Background(), workloadKinds["Deployment"], events)
+	close(events)
+
+	var expected, enqueued []string
+	for _, namespace := range []string{"web", "api", "infra"} {
+		if s.ring.owner(namespace) == identity {
+			expected = append(expected, namespace)
+		}
+	}
+	for e := range events {
+		enqueued = append(enqueued, e.Object.GetNamespace())
+	}
+	require.ElementsMatch(t, expected, enqueued)
+}
+
+// Test_shardInventory checks replicas persist workloads of their own shards only,
+// so they don't overwrite workloads of other shards using the same backup
+func Test_shardInventory(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, imgv1alpha1.AddToScheme(scheme))
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+
+	replicas := map[string]*shardMembership{}
+	for _, identity := range []string{"ctrl-0", "ctrl-1"} {
+		s := newShardMembership(c, c, "test-ki", "ctrl", identity, 15*time.Second)
+		s.members = []string{"ctrl-0", "ctrl-1"}
+		s.ring = newHashRing(s.members)
+		s.renewed = time.Now()
+		replicas[identity] = s
+	}
+	namespaceOf := map[string]string{} //replica -> namespace it owns
+	for i := 0; len(namespaceOf) < 2; i++ {
+		namespace := fmt.Sprintf("team-%d", i)
+		if owner := replicas["ctrl-0"].ring.owner(namespace); namespaceOf[owner] == "" {
+			namespaceOf[owner] = namespace
+		}
+	}
+	web := workloadRef{Kind: "Deployment", Namespace: namespaceOf["ctrl-0"], Name: "web"}
+	api := workloadRef{Kind: "Deployment", Namespace: namespaceOf["ctrl-1"], Name: "api"}
+
+	inventories := map[string]*inventory{}
+	for identity, workload := range map[string]workloadRef{"ctrl-0": web, "ctrl-1": api} {
+		inv := newInventory()
+		inv.setReferences(workload, map[string]string{"nginx:1.19": "backup:nginx_1.19"})
+		inv.recordBackup("nginx:1.19", "backup:nginx_1.19", "sha256:aaa")
+		inventories[identity] = inv
+		store := &inventoryStore{client: c, reader: c, namespace: "imgclonectrl", shards: replicas[identity]}
+		store.sync(ctx, inv)
+	}
+	list := &imgv1alpha1.ClonedImageList{}
+	require.NoError(t, c.List(ctx, list))
+	require.Len(t, list.Items, 1)
+	require.ElementsMatch(t, []string{web.String(), api.String()}, list.Items[0].Status.Workloads)
+
+	//backup used by the shard of ctrl-1 only is not owned by ctrl-0, even if loaded by it
+	redis := backupRecord{Source: "redis:6", Target: "backup:redis_6", Workloads: map[workloadRef]struct{}{api: {}}}
+	require.False(t, replicas["ctrl-0"].ownsBackup(redis))
+	require.True(t, replicas["ctrl-1"].ownsBackup(redis))
+	require.True(t, (*shardMembership)(nil).ownsBackup(backupRecord{}))
+
+	//workload of ctrl-0 is deleted: its record is persisted without it, while backup
+	//details and workloads of ctrl-1 stay as they are
+	inventories["ctrl-0"].setUpstream("nginx:1.19", "backup:nginx_1.19", upstreamMoved, "sha256:bbb")
+	inventories["ctrl-0"].forgetWorkload(web)
+	store := &inventoryStore{client: c, reader: c, namespace: "imgclonectrl", shards: replicas["ctrl-0"], loaded: true}
+	store.sync(ctx, inventories["ctrl-0"])
+	require.NoError(t, c.List(ctx, list))
+	require.Len(t, list.Items, 1)
+	require.Equal(t, []string{api.String()}, list.Items[0].Status.Workloads)
+	require.Equal(t, upstreamAvailable, list.Items[0].Status.UpstreamState)
+}
+
+// Test_shardMembershipBlockedChange checks the Lease is renewed, while onChange is blocked
+// (i.e. by cache sync), so replica keeps its namespaces
+func Test_shardMembershipBlockedChange(t *testing.T) {
+	c := fake.NewClientBuilder().Build()
+	s := newShardMembership(c, c, "test-ki", "ctrl", "ctrl-0", 300*time.Millisecond)
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	s.onChange = func(ctx context.Context) {
+		close(entered)
+		<-unblock
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Start(ctx) }()
+
+	<-entered
+	s.mu.RLock()
+	renewed := s.renewed
+	s.mu.RUnlock()
+	require.Eventually(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.renewed.After(renewed)
+	}, time.Second, 10*time.Millisecond, "lease is renewed while onChange is blocked")
+
+	close(unblock)
+	cancel()
+	require.NoError(t, <-done)
+}
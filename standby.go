@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// rewriteModeAlways - images are backed up and specs are rewritten to use backups right away
+	rewriteModeAlways = "always"
+	// rewriteModeStandby - images are backed up, but specs are rewritten only when upstream image disappears
+	rewriteModeStandby = "standby"
+	// rewriteModeDeferred - images are backed up, but specs are rewritten only along with
+	// the next change of pod template made by workload owner (see reconcileDeferred)
+	rewriteModeDeferred = "deferred"
+)
+
+// probeUpstream checks whether upstream image is available. HEAD request is used,
+// so probes are not counted against pull rate limits.
+// Only definite "not found" response (see isUpstreamGone) is treated as disappearance,
+// network errors or rate limiting are not, to not fail over on transient problems.
+func probeUpstream(ctx context.Context, image string) (available, gone bool) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return false, false
+	}
+
+	_, err = remote.Head(ref, remote.WithAuth(authn.Anonymous), remote.WithContext(ctx))
+	if err == nil {
+		return true, false
+	}
+	return false, isUpstreamGone(ref, err)
+}
+
+// backupExists checks whether backup image is present in backup registry
+func (r *reconciler) backupExists(ctx context.Context, image string) bool {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return false
+	}
+
+	_, err = targetDigest(ref, r.backupAuth(), remote.WithContext(ctx))
+	return err == nil
+}
+
+// reconcileStandby processes object in standby mode: images are backed up as usual,
+// but the spec is left untouched while upstream is healthy. Once upstream image
+// disappears, the workload is failed over to the backup (and, if standbyRevert is set,
+// switched back once upstream image is available again).
+// Workloads are re-checked every probeInterval.
+func (r *reconciler) reconcileStandby(ctx context.Context, ref workloadRef, obj client.Object) (reconcile.Result, error) {
+	lg := log.FromContext(ctx)
+	probeLater := reconcile.Result{RequeueAfter: r.probeInterval}
+
+	podSpec, err := podSpecOf(obj)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	failedOver, err := sourceImages(obj)
+	if err != nil {
+		lg.Error(err, "ignoring malformed annotation")
+	}
+
+	imageSrcDst := r.imagesToBackup(podSpec)
+
+	var pushErr error
+	if len(imageSrcDst) != 0 {
+		pushErr = r.pushImagesToBackupRegistry(ctx, imageSrcDst)
+	}
+
+	//Upstream images that disappeared, but are available in backup registry
+	failover := map[string]string{}
+	for src, dst := range imageSrcDst {
+		if _, gone := probeUpstream(ctx, src); gone && r.backupExists(ctx, dst) {
+			failover[src] = dst
+		}
+	}
+
+	//Upstream images that are available again
+	revert := map[string]string{}
+	if r.standbyRevert {
+		for dst, src := range failedOver {
+			if available, _ := probeUpstream(ctx, src); available {
+				revert[dst] = src
+			}
+		}
+	}
+
+	backedUp := condition(conditionImagesBackedUp, true, "BackedUp", "all images are in backup registry")
+	backupFailed := condition(conditionBackupFailed, false, "BackedUp", "")
+	if pushErr != nil {
+		pushErr = fmt.Errorf("could not push images to remote registry: %w", pushErr)
+		class, _ := failureClass(pushErr)
+		backedUp = condition(conditionImagesBackedUp, false, class.String(), "not all images are in backup registry")
+		backupFailed = condition(conditionBackupFailed, true, class.String(), pushErr.Error())
+	}
+
+	if len(failover) == 0 && len(revert) == 0 {
+		rewritten := condition(conditionSpecRewritten, false, "Standby", "workload uses upstream images")
+		if len(failedOver) != 0 {
+			rewritten = condition(conditionSpecRewritten, true, "FailedOver", "workload is failed over to backup images")
+		}
+		if err := r.patchConditions(ctx, obj, backedUp, rewritten, backupFailed); err != nil {
+			lg.Error(err, "could not write status")
+		}
+
+		if pushErr != nil {
+			result := r.retryLater(ctx, ref, obj, pushErr)
+			if result.RequeueAfter == 0 || result.RequeueAfter > r.probeInterval {
+				result = probeLater
+			}
+			return result, nil
+		}
+		r.backoff.reset(ref)
+		return probeLater, nil
+	}
+
+	//Re-applied, if the object is changed meanwhile
+	err = r.patchImages(ctx, ref, obj, func(obj client.Object) error {
+		sources, _ := sourceImages(obj)
+
+		if err := rewriteWorkloadImages(obj, failover); err != nil {
+			return err
+		}
+		if err := rewriteWorkloadImages(obj, revert); err != nil {
+			return err
+		}
+		for src, dst := range failover {
+			sources[dst] = src
+		}
+		for dst := range revert {
+			delete(sources, dst)
+		}
+		setSourceImages(obj, sources)
+
+		rewritten := condition(conditionSpecRewritten, false, "Reverted", "workload is switched back to upstream images")
+		if len(sources) != 0 {
+			rewritten = condition(conditionSpecRewritten, true, "FailedOver", "workload is failed over to backup images")
+		}
+		setConditions(obj, backedUp, rewritten, backupFailed)
+		return nil
+	})
+	if err != nil {
+		return r.retryLater(ctx, ref, obj, fmt.Errorf("could not write %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, err)), nil
+	}
+
+	for src, dst := range failover {
+		lg.Info(fmt.Sprintf("upstream image %q is unavailable, failed over to %q", src, dst))
+		r.event(obj, v1.EventTypeWarning, "FailedOver", fmt.Sprintf("upstream image %q is unavailable, switched to backup %q", src, dst))
+	}
+	for dst, src := range revert {
+		lg.Info(fmt.Sprintf("upstream image %q is available again, reverted from %q", src, dst))
+		r.event(obj, v1.EventTypeNormal, "Reverted", fmt.Sprintf("upstream image %q is available again, switched back from backup %q", src, dst))
+	}
+
+	r.backoff.reset(ref)
+	return probeLater, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Test_isUpstreamGone checks Docker Hub 401 to anonymous pulls is treated as deletion
+func Test_isUpstreamGone(t *testing.T) {
+	dockerHub, err := name.ParseReference("nginx:1.19")
+	require.NoError(t, err)
+	quay, err := name.ParseReference("quay.io/coreos/etcd:v3.4")
+	require.NoError(t, err)
+
+	notFound := &transport.Error{StatusCode: http.StatusNotFound}
+	unauthorized := &transport.Error{StatusCode: http.StatusUnauthorized}
+	unauthorizedCode := &transport.Error{StatusCode: http.StatusBadRequest, Errors: []transport.Diagnostic{{Code: transport.UnauthorizedErrorCode}}}
+	rateLimited := &transport.Error{StatusCode: http.StatusTooManyRequests}
+
+	require.True(t, isUpstreamGone(dockerHub, notFound))
+	require.True(t, isUpstreamGone(quay, notFound))
+	require.True(t, isUpstreamGone(dockerHub, unauthorized))
+	require.True(t, isUpstreamGone(dockerHub, unauthorizedCode))
+	require.False(t, isUpstreamGone(quay, unauthorized))
+	require.False(t, isUpstreamGone(dockerHub, rateLimited))
+}
+
+// Test_reconcileStandby checks workload is failed over to the backup, once upstream image
+// disappears, and switched back, once it's available again
+func Test_reconcileStandby(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	srcRef, err := name.ParseReference(u.Host + "/library/nginx:1.19")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(srcRef, img))
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: srcRef.String()}}},
+			},
+		},
+	}
+	r := &reconciler{
+		client:              fake.NewClientBuilder().WithObjects(deployment).Build(),
+		backupRegistry:      u.Host + "/backup",
+		maxConcurrentCopies: 1,
+		rewriteMode:         rewriteModeStandby,
+		standbyRevert:       true,
+		probeInterval:       time.Minute,
+		backoff:             newBackoffTracker(),
+	}
+	ctx := context.Background()
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: "web"}}
+	dstImage := r.getTargetImage(srcRef.String())
+	deployments := r.forKind(workloadKinds["Deployment"])
+	current := &appsv1.Deployment{}
+	reconcileAndGet := func() {
+		result, err := deployments.Reconcile(ctx, request)
+		require.NoError(t, err)
+		require.Equal(t, r.probeInterval, result.RequeueAfter)
+		require.NoError(t, r.client.Get(ctx, request.NamespacedName, current))
+	}
+
+	//backed up, but upstream image is used
+	reconcileAndGet()
+	require.Equal(t, srcRef.String(), current.Spec.Template.Spec.Containers[0].Image)
+	require.True(t, r.backupExists(ctx, dstImage))
+	require.Equal(t, "Standby", meta.FindStatusCondition(conditionsOf(current), conditionSpecRewritten).Reason)
+
+	//upstream image is deleted
+	require.NoError(t, remote.Delete(srcRef))
+	reconcileAndGet()
+	require.Equal(t, dstImage, current.Spec.Template.Spec.Containers[0].Image)
+	require.Equal(t, "FailedOver", meta.FindStatusCondition(conditionsOf(current), conditionSpecRewritten).Reason)
+	sources, err := sourceImages(current)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{dstImage: srcRef.String()}, sources)
+
+	//upstream image is back
+	require.NoError(t, remote.Write(srcRef, img))
+	reconcileAndGet()
+	require.Equal(t, srcRef.String(), current.Spec.Template.Spec.Containers[0].Image)
+	require.Equal(t, "Reverted", meta.FindStatusCondition(conditionsOf(current), conditionSpecRewritten).Reason)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	imgv1alpha1 "github.com/i-prudnikov/imgCloneCtrl/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// clonedImageSourceLabel holds hash of source image, so ClonedImages can be selected by it
+	clonedImageSourceLabel = "imgclonectrl.io/source-hash"
+)
+
+// inventoryStore persists inventory as ClonedImage objects (one per source -> target pair),
+// so it survives controller restarts and can be queried with kubectl
+type inventoryStore struct {
+	client    client.Client
+	reader    client.Reader //direct reader, so ClonedImages are not cached cluster wide
+	namespace string
+	shards    *shardMembership //namespaces of this replica, nil persists all records
+	loaded    bool             //persisted inventory was loaded
+}
+
+// shortHash returns hex encoded prefix of sha256 of values
+func shortHash(values ...string) string {
+	h := sha256.New()
+	for _, v := range values {
+		fmt.Fprintf(h, "%s\x00", v)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:20]
+}
+
+// clonedImageName returns name of ClonedImage for source -> target pair
+func clonedImageName(key copyKey) string {
+	return "img-" + shortHash(key.src, key.dst)
+}
+
+// metaTime converts time to API time (which has second precision), zero time is omitted
+func metaTime(t time.Time) *metav1.Time {
+	if t.IsZero() {
+		return nil
+	}
+	mt := metav1.NewTime(t.Truncate(time.Second))
+	return &mt
+}
+
+// fromMetaTime converts API time to time
+func fromMetaTime(t *metav1.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+// clonedImageStatus renders status of ClonedImage from inventory record
+func clonedImageStatus(record backupRecord) imgv1alpha1.ClonedImageStatus {
+	return imgv1alpha1.ClonedImageStatus{
+		Digest:         record.Digest,
+		Size:           record.Size,
+		Platforms:      record.Platforms,
+		BackedUpAt:     metaTime(record.BackedUp),
+		LastVerifiedAt: metaTime(record.LastVerified),
+		UpstreamState:  record.UpstreamState,
+		UpstreamDigest: record.UpstreamDigest,
+		UpstreamSince:  metaTime(record.UpstreamSince),
+		Workloads:      record.workloadNames(),
+	}
+}
+
+// mergeWorkloads returns workloads to persist: workloads of namespaces in the shard of this replica
+// are taken from the record, others are kept as persisted by replicas owning them
+func mergeWorkloads(persisted, own []string, shards *shardMembership) []string {
+	workloads := append([]string(nil), own...)
+	for _, value := range persisted {
+		if w, err := parseWorkloadRef(value); err == nil && !shards.owns(w.Namespace) {
+			workloads = append(workloads, value)
+		}
+	}
+	sort.Strings(workloads)
+	if len(workloads) == 0 {
+		return nil
+	}
+	return workloads
+}
+
+// load reads all ClonedImages into inventory
+func (s *inventoryStore) load(ctx context.Context, inv *inventory) error {
+	list := &imgv1alpha1.ClonedImageList{}
+	if err := s.reader.List(ctx, list, client.InNamespace(s.namespace)); err != nil {
+		return fmt.Errorf("could not list ClonedImages: %w", err)
+	}
+
+	records := make([]backupRecord, 0, len(list.Items))
+	for _, item := range list.Items {
+		records = append(records, backupRecord{
+			Source:         item.Spec.Source,
+			Target:         item.Spec.Target,
+			Digest:         item.Status.Digest,
+			Size:           item.Status.Size,
+			Platforms:      item.Status.Platforms,
+			BackedUp:       fromMetaTime(item.Status.BackedUpAt),
+			LastVerified:   fromMetaTime(item.Status.LastVerifiedAt),
+			UpstreamState:  item.Status.UpstreamState,
+			UpstreamDigest: item.Status.UpstreamDigest,
+			UpstreamSince:  fromMetaTime(item.Status.UpstreamSince),
+		})
+	}
+	inv.load(records)
+	return nil
+}
+
+// save creates or updates ClonedImage of the record
+func (s *inventoryStore) save(ctx context.Context, record backupRecord) error {
+	key := copyKey{src: record.Source, dst: record.Target}
+	status := clonedImageStatus(record)
+
+	obj := &imgv1alpha1.ClonedImage{}
+	err := s.reader.Get(ctx, types.NamespacedName{Namespace: s.namespace, Name: clonedImageName(key)}, obj)
+	if errors.IsNotFound(err) {
+		obj = &imgv1alpha1.ClonedImage{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      clonedImageName(key),
+				Namespace: s.namespace,
+				Labels:    map[string]string{clonedImageSourceLabel: shortHash(record.Source)},
+			},
+			Spec: imgv1alpha1.ClonedImageSpec{Source: record.Source, Target: record.Target},
+		}
+		if err := s.client.Create(ctx, obj); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	//With sharding replica persists workloads of its own namespaces only, and
+	//backup details only if it owns the backup (others may hold stale ones)
+	if s.shards != nil {
+		workloads := mergeWorkloads(obj.Status.Workloads, record.workloadNames(), s.shards)
+		if !s.shards.ownsBackup(record) {
+			status = obj.DeepCopy().Status
+		}
+		status.Workloads = workloads
+	}
+
+	if equality.Semantic.DeepEqual(obj.Status, status) {
+		return nil
+	}
+	obj.Status = status
+	return s.client.Status().Update(ctx, obj)
+}
+
+// sync persists changes of inventory made since the previous sync.
+// Changes that could not be persisted are retried by the next sync.
+// The first sync loads persisted inventory (sync runs only on the leader,
+// so inventory persisted by the previous leader is complete by then; with
+// sharding every replica syncs and loads images backed up by all replicas,
+// but persists only workloads of its own shard, see save)
+func (s *inventoryStore) sync(ctx context.Context, inv *inventory) {
+	lg := log.FromContext(ctx)
+	if !s.loaded {
+		if err := s.load(ctx, inv); err != nil {
+			lg.Error(err, "could not load inventory")
+			return
+		}
+		s.loaded = true
+	}
+	changed, removed := inv.takeChanges()
+
+	var failed []copyKey
+	for _, record := range changed {
+		if err := s.save(ctx, record); err != nil {
+			lg.Error(err, fmt.Sprintf("could not save ClonedImage of %q", record.Source))
+			failed = append(failed, copyKey{src: record.Source, dst: record.Target})
+		}
+	}
+
+	for _, key := range removed {
+		obj := &imgv1alpha1.ClonedImage{ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: clonedImageName(key)}}
+		if err := s.client.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			lg.Error(err, fmt.Sprintf("could not delete ClonedImage of %q", key.src))
+			failed = append(failed, key)
+		}
+	}
+
+	if len(failed) != 0 {
+		inv.markDirty(failed)
+	}
+}
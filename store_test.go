@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	imgv1alpha1 "github.com/i-prudnikov/imgCloneCtrl/api/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// Test_inventoryStore checks inventory survives restart (new inventory loaded from ClonedImages)
+func Test_inventoryStore(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, imgv1alpha1.AddToScheme(scheme))
+	cl := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+
+	inv := newInventory()
+	store := &inventoryStore{client: cl, reader: cl, namespace: "imgclonectrl"}
+	inv.setReferences(workloadRef{Kind: "Deployment", Namespace: "test", Name: "web"},
+		map[string]string{"nginx:1.19": "backup:nginx_1.19"})
+	inv.recordBackup("nginx:1.19", "backup:nginx_1.19", "sha256:aaa")
+	inv.recordDetails("nginx:1.19", "backup:nginx_1.19", 1024, []string{"linux/amd64"})
+	inv.recordBackup("redis:6", "backup:redis_6", "sha256:bbb")
+	store.sync(ctx, inv)
+
+	list := &imgv1alpha1.ClonedImageList{}
+	require.NoError(t, cl.List(ctx, list))
+	require.Len(t, list.Items, 2)
+
+	//backup is deleted
+	inv.forgetTarget("backup:redis_6")
+	store.sync(ctx, inv)
+	require.NoError(t, cl.List(ctx, list))
+	require.Len(t, list.Items, 1)
+	require.Equal(t, "nginx:1.19", list.Items[0].Spec.Source)
+	require.Equal(t, []string{"Deployment/test/web"}, list.Items[0].Status.Workloads)
+
+	//controller restart
+	restarted := newInventory()
+	store = &inventoryStore{client: cl, reader: cl, namespace: "imgclonectrl"}
+	store.sync(ctx, restarted)
+	backups := restarted.backups()
+	require.Len(t, backups, 1)
+	require.Equal(t, "sha256:aaa", backups[0].Digest)
+	require.Equal(t, int64(1024), backups[0].Size)
+	require.Equal(t, []string{"linux/amd64"}, backups[0].Platforms)
+	require.False(t, backups[0].BackedUp.IsZero())
+}
+
+// Test_inventoryStoreLoadMerge checks records registered by workloads before inventory is loaded
+// get persisted backup details, instead of overwriting them with blank ones
+func Test_inventoryStoreLoadMerge(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, imgv1alpha1.AddToScheme(scheme))
+	cl := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+
+	inv := newInventory()
+	store := &inventoryStore{client: cl, reader: cl, namespace: "imgclonectrl"}
+	inv.recordBackup("nginx:1.19", "backup:nginx_1.19", "sha256:aaa")
+	inv.recordDetails("nginx:1.19", "backup:nginx_1.19", 1024, []string{"linux/amd64"})
+	store.sync(ctx, inv)
+
+	//controller restart, workload is reconciled before the first sync
+	restarted := newInventory()
+	restarted.setReferences(workloadRef{Kind: "Deployment", Namespace: "test", Name: "web"},
+		map[string]string{"nginx:1.19": "backup:nginx_1.19"})
+	store = &inventoryStore{client: cl, reader: cl, namespace: "imgclonectrl"}
+	store.sync(ctx, restarted)
+
+	backups := restarted.backups()
+	require.Len(t, backups, 1)
+	require.Equal(t, "sha256:aaa", backups[0].Digest)
+	require.Equal(t, []string{"Deployment/test/web"}, backups[0].workloadNames())
+
+	list := &imgv1alpha1.ClonedImageList{}
+	require.NoError(t, cl.List(ctx, list))
+	require.Len(t, list.Items, 1)
+	status := list.Items[0].Status
+	require.Equal(t, "sha256:aaa", status.Digest)
+	require.Equal(t, int64(1024), status.Size)
+	require.Equal(t, upstreamAvailable, status.UpstreamState)
+	require.NotNil(t, status.BackedUpAt)
+	require.Equal(t, []string{"Deployment/test/web"}, status.Workloads)
+}
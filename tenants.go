@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// backupRegistryAnnotation of namespace overrides backup registry for workloads of the namespace
+	backupRegistryAnnotation = "imgclonectrl.io/backup-registry"
+	// backupSecretAnnotation of namespace names Secret of the namespace with credentials
+	// of the backup registry (kubernetes.io/dockerconfigjson or username and password keys)
+	backupSecretAnnotation = "imgclonectrl.io/backup-registry-secret"
+)
+
+// backupRegistries are backup registries in use (default one and ones of namespaces) with their
+// credentials, so backups are verified and monitored with credentials they were pushed with.
+// Namespaces may share backup repository with credentials of their own, so credentials are kept
+// per namespace (default credentials under empty namespace)
+type backupRegistries struct {
+	mu        sync.Mutex
+	auth      map[string]map[string]authn.AuthConfig //repository -> namespace -> credentials
+	fallbacks map[string]struct{}                    //namespaces reported to fall back to default registry
+}
+
+func newBackupRegistries() *backupRegistries {
+	return &backupRegistries{auth: map[string]map[string]authn.AuthConfig{}, fallbacks: map[string]struct{}{}}
+}
+
+// fallbackReported remembers the namespace falls back to default backup registry and tells, whether
+// it was reported already, so fallback is reported once per namespace. Nil registries report it every time
+func (b *backupRegistries) fallbackReported(namespace string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, reported := b.fallbacks[namespace]
+	b.fallbacks[namespace] = struct{}{}
+	return reported
+}
+
+// put remembers credentials of the backup registry used by the namespace (empty for default
+// credentials). Nil registries do nothing
+func (b *backupRegistries) put(registry, namespace string, auth authn.AuthConfig) {
+	repo, err := name.NewRepository(registry)
+	if b == nil || err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.auth[repo.Name()] == nil {
+		b.auth[repo.Name()] = map[string]authn.AuthConfig{}
+	}
+	b.auth[repo.Name()][namespace] = auth
+}
+
+// authOf returns credentials of the backup repository, if it's known: credentials of the first
+// of namespaces using it, default credentials or credentials of any namespace otherwise
+func (b *backupRegistries) authOf(repo name.Repository, namespaces ...string) (authn.AuthConfig, bool) {
+	if b == nil {
+		return authn.AuthConfig{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	byNamespace, known := b.auth[repo.Name()]
+	if !known {
+		return authn.AuthConfig{}, false
+	}
+	for _, namespace := range append(namespaces, "") {
+		if auth, used := byNamespace[namespace]; used {
+			return auth, true
+		}
+	}
+	others := make([]string, 0, len(byNamespace))
+	for namespace := range byNamespace {
+		others = append(others, namespace)
+	}
+	sort.Strings(others)
+	return byNamespace[others[0]], true
+}
+
+// authOption returns authentication option for the credentials, anonymous if they are not complete
+func authOption(auth authn.AuthConfig) remote.Option {
+	if auth.Username == "" || auth.Password == "" {
+		return remote.WithAuth(authn.Anonymous)
+	}
+	return remote.WithAuth(authn.FromConfig(auth))
+}
+
+// targetAuth returns authentication option for the backup image: credentials of backup
+// registry it was pushed to (by workloads of the namespaces), default backup registry
+// credentials if it's not known
+func (r *reconciler) targetAuth(target name.Reference, namespaces ...string) remote.Option {
+	if auth, known := r.registries.authOf(target.Context(), namespaces...); known {
+		return authOption(auth)
+	}
+	return r.backupAuth()
+}
+
+// forNamespace returns reconciler backing up images of workloads in the namespace. Backup registry
+// is overridden with backupRegistryAnnotation of the namespace, credentials with backupSecretAnnotation
+// (if Secret is not set, default credentials are used for the host of default backup registry only,
+// anonymous access for other hosts). NOTE! Returned reconciler is a shallow copy.
+// Namespace scoped controller may be not allowed to get namespaces, then registry is not overridden
+// (reported with registryFallback of the first reconciler of the namespace)
+func (r *reconciler) forNamespace(ctx context.Context, namespace string) (*reconciler, error) {
+	r.registries.put(r.backupRegistry, "", r.authConfig)
+
+	ns := &v1.Namespace{}
+	if err := r.namespaceReader().Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+		if errors.IsNotFound(err) {
+			return r, nil
+		}
+		if r.namespaceScoped && errors.IsForbidden(err) {
+			if r.registries.fallbackReported(namespace) {
+				return r, nil
+			}
+			fallback := *r
+			fallback.registryFallback = fmt.Sprintf("namespace %s can not be read, so its backup registry annotations are not known, "+
+				"default backup registry %q is used", namespace, r.backupRegistry)
+			log.FromContext(ctx).Info(fallback.registryFallback)
+			return &fallback, nil
+		}
+		return nil, fmt.Errorf("could not get namespace %s: %w", namespace, err)
+	}
+	registry, overridden := ns.Annotations[backupRegistryAnnotation]
+	if !overridden || registry == "" {
+		return r, nil
+	}
+	repo, err := name.NewRepository(registry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup registry %q of namespace %s: %w", registry, namespace, err)
+	}
+
+	tenant := *r
+	tenant.backupRegistry = registry
+	if secretName := ns.Annotations[backupSecretAnnotation]; secretName != "" {
+		auth, err := r.registrySecret(ctx, namespace, secretName, registry)
+		if err != nil {
+			return nil, err
+		}
+		tenant.authConfig = auth
+	} else if defaultRepo, err := name.NewRepository(r.backupRegistry); err != nil || defaultRepo.RegistryStr() != repo.RegistryStr() {
+		//default credentials are never sent to the host named by namespace annotation
+		tenant.authConfig = authn.AuthConfig{}
+	}
+	r.registries.put(tenant.backupRegistry, namespace, tenant.authConfig)
+	return &tenant, nil
+}
+
+// dockerConfig is content of kubernetes.io/dockerconfigjson Secret
+type dockerConfig struct {
+	Auths map[string]struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Auth     string `json:"auth"`
+	} `json:"auths"`
+}
+
+// registrySecret returns credentials of the registry from the Secret. Secrets are read with
+// uncached reader, so they are not cached cluster wide
+func (r *reconciler) registrySecret(ctx context.Context, namespace, secretName, registry string) (authn.AuthConfig, error) {
+	secret := &v1.Secret{}
+	if err := r.uncachedReader().Get(ctx, types.NamespacedName{Namespace: namespace, Name: secretName}, secret); err != nil {
+		return authn.AuthConfig{}, fmt.Errorf("could not get secret %s/%s: %w", namespace, secretName, err)
+	}
+
+	if secret.Type != v1.SecretTypeDockerConfigJson {
+		return authn.AuthConfig{Username: string(secret.Data["username"]), Password: string(secret.Data["password"])}, nil
+	}
+
+	config := dockerConfig{}
+	if err := json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], &config); err != nil {
+		return authn.AuthConfig{}, fmt.Errorf("could not parse secret %s/%s: %w", namespace, secretName, err)
+	}
+	repo, err := name.NewRepository(registry)
+	if err != nil {
+		return authn.AuthConfig{}, err
+	}
+	for host, entry := range config.Auths {
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+		if strings.TrimSuffix(host, "/") != repo.RegistryStr() {
+			continue
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return authn.AuthConfig{}, fmt.Errorf("could not decode auth of %s in secret %s/%s: %w", host, namespace, secretName, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) == 2 {
+				return authn.AuthConfig{Username: parts[0], Password: parts[1]}, nil
+			}
+		}
+		return authn.AuthConfig{Username: entry.Username, Password: entry.Password}, nil
+	}
+	return authn.AuthConfig{}, fmt.Errorf("no credentials of %s in secret %s/%s", repo.RegistryStr(), namespace, secretName)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// Test_forNamespace checks backup registry and credentials are overridden by namespace annotations
+func Test_forNamespace(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("team-a-robot:s3cr3t"))
+	r := &reconciler{
+		client: fake.NewClientBuilder().WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Annotations: map[string]string{
+				backupRegistryAnnotation: "harbor.example.com/team-a/backup",
+				backupSecretAnnotation:   "backup-registry",
+			}}},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "backup-registry", Namespace: "team-a"},
+				Type:       corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(
+					`{"auths":{"https://harbor.example.com":{"auth":"` + auth + `"}}}`)},
+			},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Annotations: map[string]string{
+				backupRegistryAnnotation: "harbor.example.com/team-b/backup",
+			}}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-c", Annotations: map[string]string{
+				backupRegistryAnnotation: "registry.example.com/team-c/backup",
+			}}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shared"}},
+		).Build(),
+		backupRegistry: "registry.example.com/backup",
+		authConfig:     authn.AuthConfig{Username: "robot", Password: "default"},
+		registries:     newBackupRegistries(),
+	}
+	ctx := context.Background()
+
+	tenant, err := r.forNamespace(ctx, "team-a")
+	require.NoError(t, err)
+	require.Equal(t, "harbor.example.com/team-a/backup", tenant.backupRegistry)
+	require.Equal(t, authn.AuthConfig{Username: "team-a-robot", Password: "s3cr3t"}, tenant.authConfig)
+	require.Equal(t, "harbor.example.com/team-a/backup:nginx_1.19", tenant.getTargetImage("nginx:1.19"))
+	require.Equal(t, "registry.example.com/backup", r.backupRegistry, "default registry is not changed")
+
+	//default credentials are not sent to other registry host without Secret
+	tenant, err = r.forNamespace(ctx, "team-b")
+	require.NoError(t, err)
+	require.Equal(t, "harbor.example.com/team-b/backup", tenant.backupRegistry)
+	require.Equal(t, authn.AuthConfig{}, tenant.authConfig)
+	repo, err := name.NewRepository("harbor.example.com/team-b/backup")
+	require.NoError(t, err)
+	teamAuth, known := r.registries.authOf(repo, "team-b")
+	require.True(t, known)
+	require.Equal(t, authn.AuthConfig{}, teamAuth)
+	require.Equal(t, "robot", r.authConfig.Username, "default credentials are not changed")
+
+	//default credentials are used for the host of default backup registry without Secret
+	tenant, err = r.forNamespace(ctx, "team-c")
+	require.NoError(t, err)
+	require.Equal(t, "registry.example.com/team-c/backup", tenant.backupRegistry)
+	require.Equal(t, r.authConfig, tenant.authConfig)
+
+	tenant, err = r.forNamespace(ctx, "shared")
+	require.NoError(t, err)
+	require.Equal(t, r, tenant)
+
+	//backups of all namespaces are known
+	require.True(t, r.isBackupImage("harbor.example.com/team-a/backup:nginx_1.19"))
+	require.True(t, r.isBackupImage("registry.example.com/backup:nginx_1.19"))
+	require.False(t, r.isBackupImage("harbor.example.com/team-a/app:1.0"))
+}
+
+// Test_backupRegistries checks namespaces sharing backup repository keep credentials of their own
+func Test_backupRegistries(t *testing.T) {
+	b := newBackupRegistries()
+	b.put("harbor.example.com/shared/backup", "team-a", authn.AuthConfig{Username: "team-a-robot", Password: "a"})
+	b.put("harbor.example.com/shared/backup", "team-b", authn.AuthConfig{Username: "team-b-robot", Password: "b"})
+	repo, err := name.NewRepository("harbor.example.com/shared/backup")
+	require.NoError(t, err)
+
+	auth, known := b.authOf(repo, "team-b")
+	require.True(t, known)
+	require.Equal(t, "team-b-robot", auth.Username)
+	auth, known = b.authOf(repo, "team-a", "team-b")
+	require.True(t, known)
+	require.Equal(t, "team-a-robot", auth.Username)
+	auth, known = b.authOf(repo) //i.e. loaded records have no workloads
+	require.True(t, known)
+	require.Equal(t, "team-a-robot", auth.Username)
+
+	b.put("harbor.example.com/shared/backup", "", authn.AuthConfig{Username: "robot", Password: "default"})
+	auth, _ = b.authOf(repo, "team-c")
+	require.Equal(t, "robot", auth.Username, "default credentials")
+
+	other, err := name.NewRepository("harbor.example.com/other/backup")
+	require.NoError(t, err)
+	_, known = b.authOf(other, "team-a")
+	require.False(t, known)
+}
+
+// forbiddenClient denies reads, like API server does for namespace scoped controller reading namespaces
+type forbiddenClient struct {
+	client.Client
+}
+
+func (forbiddenClient) Get(_ context.Context, key types.NamespacedName, _ client.Object) error {
+	return errors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, key.Name, nil)
+}
+
+// Test_forNamespaceScoped checks namespace scoped controller reads namespaces directly
+// and keeps default registry, when it's not allowed to read them
+func Test_forNamespaceScoped(t *testing.T) {
+	team := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Annotations: map[string]string{
+		backupRegistryAnnotation: "harbor.example.com/team-a/backup",
+	}}}
+	r := &reconciler{
+		client:          fake.NewClientBuilder().Build(),
+		apiReader:       fake.NewClientBuilder().WithObjects(team).Build(),
+		backupRegistry:  "registry.example.com/backup",
+		namespaceScoped: true,
+		registries:      newBackupRegistries(),
+	}
+	ctx := context.Background()
+
+	tenant, err := r.forNamespace(ctx, "team-a")
+	require.NoError(t, err)
+	require.Equal(t, "harbor.example.com/team-a/backup", tenant.backupRegistry)
+
+	r.apiReader = forbiddenClient{r.client}
+	tenant, err = r.forNamespace(ctx, "team-a")
+	require.NoError(t, err)
+	require.Equal(t, r.backupRegistry, tenant.backupRegistry)
+	require.Contains(t, tenant.registryFallback, "namespace team-a can not be read", "fallback is reported")
+	tenant, err = r.forNamespace(ctx, "team-a")
+	require.NoError(t, err)
+	require.Equal(t, r.backupRegistry, tenant.backupRegistry)
+	require.Empty(t, tenant.registryFallback, "fallback is reported once per namespace")
+
+	//forbidden is an error for cluster wide controller
+	r.namespaceScoped = false
+	r.client = forbiddenClient{r.client}
+	_, err = r.forNamespace(ctx, "team-a")
+	require.Error(t, err)
+}
+
+func Test_registrySecret(t *testing.T) {
+	r := &reconciler{client: fake.NewClientBuilder().WithObjects(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "basic", Namespace: "team-a"},
+			Type:       corev1.SecretTypeBasicAuth,
+			Data:       map[string][]byte{"username": []byte("robot"), "password": []byte("s3cr3t")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "other-registry", Namespace: "team-a"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(
+				`{"auths":{"quay.io":{"username":"robot","password":"s3cr3t"}}}`)},
+		},
+	).Build()}
+	ctx := context.Background()
+
+	auth, err := r.registrySecret(ctx, "team-a", "basic", "harbor.example.com/team-a/backup")
+	require.NoError(t, err)
+	require.Equal(t, authn.AuthConfig{Username: "robot", Password: "s3cr3t"}, auth)
+
+	_, err = r.registrySecret(ctx, "team-a", "other-registry", "harbor.example.com/team-a/backup")
+	require.Error(t, err)
+	_, err = r.registrySecret(ctx, "team-a", "missing", "harbor.example.com/team-a/backup")
+	require.Error(t, err)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	crv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// blobBackoff is backoff between attempts to upload the same blob
+var blobBackoff = backoffPolicy{base: 2 * time.Second, max: time.Minute}
+
+// imageSize returns compressed size of the image (config and layers), as stated in its manifest
+func imageSize(img crv1.Image) (int64, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return 0, err
+	}
+
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return size, nil
+}
+
+// imagePlatforms returns platform of the image as os/arch
+func imagePlatforms(img crv1.Image) []string {
+	config, err := img.ConfigFile()
+	if err != nil || config.OS == "" {
+		return nil
+	}
+
+	return []string{config.OS + "/" + config.Architecture}
+}
+
+// copyTimeout returns time given to copy the image of the size: copyTimeoutBase
+// plus time to transfer the image at minCopyThroughput. Zero means no timeout
+func (r *reconciler) copyTimeout(size int64) time.Duration {
+	if r.copyTimeoutBase <= 0 {
+		return 0
+	}
+	timeout := r.copyTimeoutBase
+	if r.minCopyThroughput > 0 {
+		timeout += time.Duration(size/r.minCopyThroughput) * time.Second
+	}
+	return timeout
+}
+
+// limitCopy cancels the copy of the image, once time given to copy it is over. Source image
+// is read lazily, while it's written to backup registry, so cancel must be the one of the context
+// both source image was fetched and destination requests are made with. Returned function stops the timer
+func (r *reconciler) limitCopy(ctx context.Context, img crv1.Image, target string, cancel context.CancelFunc) func() {
+	size, err := imageSize(img)
+	if err != nil {
+		return func() {}
+	}
+	timeout := r.copyTimeout(size)
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	log.FromContext(ctx).Info(fmt.Sprintf("copying %d bytes to %q, timeout %s", size, target, timeout))
+	timer := time.AfterFunc(timeout, cancel)
+	return func() { timer.Stop() }
+}
+
+// writeImage pushes image to backup registry blob by blob, and commits the manifest
+// only when all the blobs are uploaded.
+// Every blob upload is retried on its own, so a failure of one layer of a large
+// image does not restart the whole copy. Blobs already present in backup repository
+// (i.e. uploaded before the previous failure or controller restart) are skipped.
+func (r *reconciler) writeImage(ctx context.Context, dstRef name.Reference, img crv1.Image, opts ...remote.Option) error {
+	//the latest context option wins
+	opts = append(opts, remote.WithContext(ctx))
+
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("could not read layers: %w", err)
+	}
+	config, err := partial.ConfigLayer(img)
+	if err != nil {
+		return fmt.Errorf("could not read config: %w", err)
+	}
+
+	uploaded := map[crv1.Hash]struct{}{}
+	for _, blob := range append(layers, config) {
+		mt, err := blob.MediaType()
+		if err != nil {
+			return err
+		}
+		if !mt.IsDistributable() { //foreign layers are not pushed
+			continue
+		}
+
+		digest, err := blob.Digest()
+		if err != nil {
+			return err
+		}
+		if _, done := uploaded[digest]; done {
+			continue
+		}
+
+		if err := r.writeBlob(ctx, dstRef.Context(), blob, opts...); err != nil {
+			return fmt.Errorf("could not upload blob %s: %w", digest, err)
+		}
+		uploaded[digest] = struct{}{}
+	}
+
+	//All blobs are in place, so this only checks them and puts the manifest
+	return remote.Write(dstRef, img, opts...)
+}
+
+// writeBlob uploads single blob, retrying up to blobRetries times unless failure is permanent
+func (r *reconciler) writeBlob(ctx context.Context, repo name.Repository, blob crv1.Layer, opts ...remote.Option) error {
+	lg := log.FromContext(ctx)
+
+	for attempt := 1; ; attempt++ {
+		err := remote.WriteLayer(repo, blob, opts...)
+		if err == nil {
+			return nil
+		}
+		if attempt >= r.blobRetries || classifyError(err).permanent() || ctx.Err() != nil {
+			return err
+		}
+
+		delay := blobBackoff.delay(attempt)
+		lg.Info(fmt.Sprintf("blob upload to %q failed (attempt %d of %d), retrying in %s: %v",
+			repo.String(), attempt, r.blobRetries, delay, err))
+		blobRetries.WithLabelValues(repo.RegistryStr()).Inc()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
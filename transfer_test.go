@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_copyTimeout(t *testing.T) {
+	r := &reconciler{}
+	require.Equal(t, time.Duration(0), r.copyTimeout(100<<20), "no timeout")
+
+	r.copyTimeoutBase = 30 * time.Second
+	require.Equal(t, 30*time.Second, r.copyTimeout(100<<20), "no throughput expectation")
+
+	r.minCopyThroughput = 1 << 20
+	require.Equal(t, 40*time.Second, r.copyTimeout(10<<20))
+	require.Equal(t, 30*time.Second, r.copyTimeout(1<<19), "less than a second of transfer")
+}
+
+// Test_writeBlob checks failed blob uploads are retried, and blobs already in backup repository are skipped
+func Test_writeBlob(t *testing.T) {
+	defer func(policy backoffPolicy) { blobBackoff = policy }(blobBackoff)
+	blobBackoff = backoffPolicy{base: time.Millisecond, max: time.Millisecond}
+
+	var uploads, failures int32
+	handler := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost && strings.Contains(req.URL.Path, "/blobs/uploads") {
+			atomic.AddInt32(&uploads, 1)
+			//not retried by go-containerregistry itself, unlike 5xx
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	repo, err := name.NewRepository(u.Host + "/backup")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	blob, err := random.Layer(1024, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	require.NoError(t, err)
+
+	//the first attempt fails
+	atomic.StoreInt32(&failures, 1)
+	r := &reconciler{blobRetries: 3}
+	require.NoError(t, r.writeBlob(ctx, repo, blob))
+	require.Equal(t, int32(2), atomic.LoadInt32(&uploads))
+
+	//blob is in the repository already
+	require.NoError(t, r.writeBlob(ctx, repo, blob))
+	require.Equal(t, int32(2), atomic.LoadInt32(&uploads))
+
+	//retries are exhausted
+	another, err := random.Layer(1024, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	require.NoError(t, err)
+	atomic.StoreInt32(&failures, 5)
+	r.blobRetries = 2
+	require.Error(t, r.writeBlob(ctx, repo, another))
+	require.Equal(t, int32(4), atomic.LoadInt32(&uploads))
+}
+
+// Test_copyImageTimeout checks the timeout covers reads of the source image, not only writes to backup registry
+func Test_copyImageTimeout(t *testing.T) {
+	var stall int32
+	handler := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&stall) == 1 && req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/library/nginx/blobs/") {
+			<-req.Context().Done()
+			return
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	srcRef, err := name.ParseReference(u.Host + "/library/nginx:1.19")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(srcRef, img))
+	atomic.StoreInt32(&stall, 1)
+
+	r := &reconciler{backupRegistry: u.Host + "/backup", copyTimeoutBase: 200 * time.Millisecond, blobRetries: 1}
+	started := time.Now()
+	err = r.copyImage(context.Background(), srcRef.String(), r.getTargetImage(srcRef.String()))
+	require.Error(t, err)
+	require.True(t, time.Since(started) < 10*time.Second, "copy is cancelled by timeout")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	crv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// brokenBackupError reports backup definitely missing or damaged in backup registry
+// (as opposed to failures to reach backup registry)
+type brokenBackupError struct {
+	reason string
+}
+
+func (e *brokenBackupError) Error() string {
+	return e.reason
+}
+
+// verifyBackup checks backup image exists with the digest and all its blobs are in
+// backup registry. Blobs are checked with HEAD requests, so they are not downloaded
+func verifyBackup(dstRef name.Reference, digest string, opts ...remote.Option) error {
+	desc, err := remote.Get(dstRef, opts...)
+	if err != nil {
+		if isNotFound(err) {
+			return &brokenBackupError{reason: fmt.Sprintf("backup %q does not exist", dstRef.String())}
+		}
+		return err
+	}
+	if desc.Digest.String() != digest {
+		return &brokenBackupError{reason: fmt.Sprintf("backup %q has digest %s instead of %s", dstRef.String(), desc.Digest, digest)}
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range append([]crv1.Descriptor{manifest.Config}, manifest.Layers...) {
+		if !blob.MediaType.IsDistributable() { //foreign layers are not pushed
+			continue
+		}
+		layer, err := remote.Layer(dstRef.Context().Digest(blob.Digest.String()), opts...)
+		if err != nil {
+			return err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			if isNotFound(err) {
+				return &brokenBackupError{reason: fmt.Sprintf("blob %s of backup %q is missing", blob.Digest, dstRef.String())}
+			}
+			return err
+		}
+		if size >= 0 && blob.Size != 0 && size != blob.Size {
+			return &brokenBackupError{reason: fmt.Sprintf("blob %s of backup %q has size %d instead of %d",
+				blob.Digest, dstRef.String(), size, blob.Size)}
+		}
+	}
+	return nil
+}
+
+// repairBackup pushes the backup again from upstream, if upstream still holds the backed up image.
+// Image is pulled by digest, so it's found even if upstream tag has moved. Error is returned, if
+// upstream could not be checked, so backup is declared lost only once upstream is known to be gone
+func (r *reconciler) repairBackup(ctx context.Context, record backupRecord) (bool, error) {
+	srcRef, err := name.ParseReference(record.Source)
+	if err != nil {
+		return false, err
+	}
+	dstRef, err := name.ParseReference(record.Target)
+	if err != nil {
+		return false, err
+	}
+
+	switch state, _ := r.upstreamState(ctx, record); state {
+	case "":
+		return false, fmt.Errorf("could not check upstream image %q", record.Source)
+	case upstreamDeleted:
+		return false, nil
+	}
+	srcRef = srcRef.Context().Digest(record.Digest)
+
+	if r.registryLimiter != nil {
+		release, err := r.registryLimiter.acquire(ctx, srcRef.Context().RegistryStr())
+		if err != nil {
+			return false, err
+		}
+		defer release()
+	}
+
+	//Whole copy is cancelled, once time given to copy the image is over (see limitCopy)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	manifestRequests.WithLabelValues(srcRef.Context().RegistryStr()).Inc()
+	srcImg, err := remote.Image(srcRef, remote.WithAuth(authn.Anonymous), remote.WithContext(ctx))
+	if err != nil {
+		if isUpstreamGone(srcRef, err) { //image of moved tag is deleted upstream
+			return false, nil
+		}
+		return false, err
+	}
+
+	//Blobs still in backup registry are not uploaded again
+	defer r.limitCopy(ctx, srcImg, dstRef.String(), cancel)()
+	if err := r.writeImage(ctx, dstRef, srcImg, r.targetAuth(dstRef, record.namespaces()...), remote.WithContext(ctx)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// verifyBackups checks every recorded backup is still in backup registry, intact.
+// Broken backups are pushed again from upstream, when upstream still holds the same image
+// (even if upstream tag has moved). Otherwise backup is lost, which is reported with metric, log entry and events on workloads.
+func (r *reconciler) verifyBackups(ctx context.Context) {
+	lg := log.FromContext(ctx)
+
+	for _, record := range r.inventory.backups() {
+		if ctx.Err() != nil {
+			return
+		}
+		if record.Digest == "" || !r.shards.ownsBackup(record) { //digest is learned by upstream monitor
+			continue
+		}
+		dstRef, err := name.ParseReference(record.Target)
+		if err != nil {
+			continue
+		}
+
+		err = verifyBackup(dstRef, record.Digest, r.targetAuth(dstRef, record.namespaces()...), remote.WithContext(ctx))
+		if err == nil {
+			r.inventory.markVerified(record.Source, record.Target)
+			backupLost.DeleteLabelValues(record.Source, record.Target)
+			continue
+		}
+		if _, broken := err.(*brokenBackupError); !broken {
+			lg.Error(err, fmt.Sprintf("could not verify backup %q", record.Target))
+			continue
+		}
+
+		lg.Info(fmt.Sprintf("%v, pushing it again from %q", err, record.Source))
+		repaired, repairErr := r.repairBackup(ctx, record)
+		if repaired {
+			backupRepairs.Inc()
+			r.inventory.markVerified(record.Source, record.Target)
+			backupLost.DeleteLabelValues(record.Source, record.Target)
+			lg.Info(fmt.Sprintf("backup %q is repaired", record.Target))
+			continue
+		}
+		if repairErr != nil { //upstream may still hold the image, retried by the next pass
+			lg.Error(repairErr, fmt.Sprintf("could not repair backup %q", record.Target))
+			continue
+		}
+
+		message := fmt.Sprintf("%v, and upstream image %q is gone: backup was the last copy", err, record.Source)
+		backupLost.WithLabelValues(record.Source, record.Target).Set(1)
+		lg.Error(err, message, "workloads", strings.Join(record.workloadNames(), ","))
+		r.workloadEvents(ctx, record, v1.EventTypeWarning, "BackupLost", message)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// Test_verifyBackup checks verification of backups in backup registry
+func Test_verifyBackup(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	dstRef, err := name.ParseReference(u.Host + "/backup:nginx_1.19")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(dstRef, img))
+
+	require.NoError(t, verifyBackup(dstRef, digest.String()))
+
+	err = verifyBackup(dstRef, "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	require.IsType(t, &brokenBackupError{}, err)
+
+	missingRef, err := name.ParseReference(u.Host + "/backup:redis_6")
+	require.NoError(t, err)
+	err = verifyBackup(missingRef, digest.String())
+	require.IsType(t, &brokenBackupError{}, err)
+}
+
+// Test_verifyBackups checks broken backups are repaired from upstream (even if upstream tag has moved),
+// and are declared lost only once upstream image is deleted
+func Test_verifyBackups(t *testing.T) {
+	upstream := httptest.NewServer(registry.New())
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	backup := httptest.NewServer(registry.New())
+	defer backup.Close()
+	backupURL, err := url.Parse(backup.URL)
+	require.NoError(t, err)
+	//registry, which can not be reached
+	gone := httptest.NewServer(registry.New())
+	goneURL, err := url.Parse(gone.URL)
+	require.NoError(t, err)
+	gone.Close()
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	srcRef, err := name.ParseReference(upstreamURL.Host + "/library/nginx:1.19")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(srcRef, img))
+	dstRef, err := name.ParseReference(backupURL.Host + "/backup:library_nginx_1.19")
+	require.NoError(t, err)
+	unreachableSrc := goneURL.Host + "/library/redis:6"
+	unreachableDst, err := name.ParseReference(backupURL.Host + "/backup:library_redis_6")
+	require.NoError(t, err)
+
+	web := workloadRef{Kind: "Deployment", Namespace: "test", Name: "web"}
+	inv := newInventory()
+	inv.setReferences(web, map[string]string{srcRef.String(): dstRef.String(), unreachableSrc: unreachableDst.String()})
+	inv.recordBackup(srcRef.String(), dstRef.String(), digest.String())
+	inv.recordBackup(unreachableSrc, unreachableDst.String(), digest.String())
+
+	recorder := record.NewFakeRecorder(10)
+	r := &reconciler{
+		client:         fake.NewClientBuilder().WithObjects(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "web"}}).Build(),
+		backupRegistry: backupURL.Host + "/backup",
+		inventory:      inv,
+		recorder:       recorder,
+	}
+	ctx := context.Background()
+	breakBackups := func() {
+		other, err := random.Image(1024, 1)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(dstRef, other))
+		require.NoError(t, remote.Write(unreachableDst, other))
+	}
+	backupDigest := func(ref name.Reference) string {
+		got, err := targetDigest(ref)
+		require.NoError(t, err)
+		return got.String()
+	}
+
+	//upstream holds the image
+	breakBackups()
+	r.verifyBackups(ctx)
+	require.Equal(t, digest.String(), backupDigest(dstRef))
+
+	//upstream tag has moved, previous image is pulled by digest
+	moved, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(srcRef, moved))
+	breakBackups()
+	r.verifyBackups(ctx)
+	require.Equal(t, digest.String(), backupDigest(dstRef))
+
+	//upstream of redis could not be checked, so its backup is not declared lost
+	require.NotEqual(t, digest.String(), backupDigest(unreachableDst))
+	require.Empty(t, recorder.Events)
+
+	//upstream image is deleted
+	require.NoError(t, remote.Delete(srcRef))
+	breakBackups()
+	r.verifyBackups(ctx)
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, "BackupLost")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	crv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// tagMutationPreserve - backup tag keeps the image it was taken from, new upstream
+	// image is backed up to digest suffixed tag
+	tagMutationPreserve = "preserve"
+	// tagMutationHistory - image held by backup tag is kept under digest suffixed tag,
+	// and backup tag is overwritten by new upstream image
+	tagMutationHistory = "history"
+	// tagMutationOverwrite - backup tag is overwritten by new upstream image
+	tagMutationOverwrite = "overwrite"
+
+	// maxTagLength is the limit of tag length, set by distribution spec
+	maxTagLength = 128
+	// historyDigestLength is the number of digest hex characters added to history tags
+	historyDigestLength = 12
+)
+
+// historyTag returns digest suffixed tag for the image of backup tag, i.e.
+// backup:library_nginx_1.19 -> backup:library_nginx_1.19_0123456789ab
+func historyTag(ref name.Reference, digest crv1.Hash) (name.Tag, error) {
+	tag, isTag := ref.(name.Tag)
+	if !isTag {
+		return name.Tag{}, fmt.Errorf("%q is not a tag", ref.String())
+	}
+
+	suffix := digest.Hex
+	if len(suffix) > historyDigestLength {
+		suffix = suffix[:historyDigestLength]
+	}
+	base := tag.TagStr()
+	if len(base)+1+len(suffix) > maxTagLength {
+		base = base[:maxTagLength-1-len(suffix)]
+	}
+
+	return tag.Context().Tag(fmt.Sprintf("%s_%s", base, suffix)), nil
+}
+
+// historyBase returns backup tag of the digest suffixed tag (see historyTag), if the tag is
+// digest suffixed tag of the image it points to
+func historyBase(tag, digest string) (string, bool) {
+	hash, err := crv1.NewHash(digest)
+	if err != nil || len(hash.Hex) < historyDigestLength {
+		return "", false
+	}
+	suffix := "_" + hash.Hex[:historyDigestLength]
+	if !strings.HasSuffix(tag, suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(tag, suffix), true
+}
+
+// preservedEvents reports workload images, backups of which hold previous images of moved upstream
+// tags (see tagMutationPreserve): workload is switched to the previous image, while the new one
+// is backed up to digest suffixed tag and is not used
+func (r *reconciler) preservedEvents(ctx context.Context, obj client.Object, imageSrcDst map[string]string) {
+	for src, digest := range r.inventory.movedUpstream(imageSrcDst) {
+		message := fmt.Sprintf("upstream image %q was moved to %s, backup %q holds the previous image", src, digest, imageSrcDst[src])
+		dstRef, err := name.ParseReference(imageSrcDst[src])
+		hash, hashErr := crv1.NewHash(digest)
+		if err == nil && hashErr == nil {
+			if history, err := historyTag(dstRef, hash); err == nil {
+				message += fmt.Sprintf(", the new one is backed up as %q", history.String())
+			}
+		}
+		log.FromContext(ctx).Info(message)
+		r.event(obj, v1.EventTypeWarning, "BackupPreserved", message)
+	}
+}
+
+// keepHistory copies image held by backup tag to its digest suffixed tag.
+// Blobs are already in the repository, so only the manifest is put
+func keepHistory(ctx context.Context, dstRef name.Reference, dstHash crv1.Hash, opts ...remote.Option) error {
+	history, err := historyTag(dstRef, dstHash)
+	if err != nil {
+		return err
+	}
+
+	if digest, err := targetDigest(history, opts...); err == nil && digest == dstHash {
+		return nil //already kept
+	}
+
+	desc, err := remote.Get(dstRef, opts...)
+	if err != nil {
+		return err
+	}
+	if desc.Digest != dstHash { //backup tag was moved meanwhile
+		return fmt.Errorf("backup %q was changed during the copy", dstRef.String())
+	}
+
+	log.FromContext(ctx).Info(fmt.Sprintf("keeping previous backup %q as %q", dstRef.String(), history.String()))
+	return remote.Tag(history, desc, opts...)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func Test_historyTag(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	ref, err := name.ParseReference("registry.example.com/backup:library_nginx_1.19")
+	require.NoError(t, err)
+	history, err := historyTag(ref, digest)
+	require.NoError(t, err)
+	require.Equal(t, "registry.example.com/backup:library_nginx_1.19_"+digest.Hex[:historyDigestLength], history.String())
+
+	//long tags are truncated, so the suffix fits into the limit
+	long, err := name.ParseReference("registry.example.com/backup:" + strings.Repeat("a", maxTagLength))
+	require.NoError(t, err)
+	history, err = historyTag(long, digest)
+	require.NoError(t, err)
+	require.Len(t, history.TagStr(), maxTagLength)
+	require.True(t, strings.HasSuffix(history.TagStr(), "_"+digest.Hex[:historyDigestLength]))
+
+	_, err = historyTag(ref.Context().Digest(digest.String()), digest)
+	require.Error(t, err)
+}
+
+func Test_keepHistory(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	dstRef, err := name.ParseReference(u.Host + "/backup:library_nginx_1.19")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(dstRef, img))
+
+	require.NoError(t, keepHistory(ctx, dstRef, digest))
+	history, err := historyTag(dstRef, digest)
+	require.NoError(t, err)
+	kept, err := targetDigest(history)
+	require.NoError(t, err)
+	require.Equal(t, digest, kept)
+	require.NoError(t, keepHistory(ctx, dstRef, digest), "kept already")
+
+	//backup tag was moved meanwhile
+	other, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	otherDigest, err := other.Digest()
+	require.NoError(t, err)
+	require.Error(t, keepHistory(ctx, dstRef, otherDigest))
+}
+
+// Test_preservedBackup checks workload switched to preserved backup of a moved upstream tag is reported
+func Test_preservedBackup(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	srcRef, err := name.ParseReference(u.Host + "/library/nginx:1.19")
+	require.NoError(t, err)
+	previous, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(srcRef, previous))
+
+	deployment := func(name string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test"},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": name}},
+					Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: srcRef.String()}}},
+				},
+			},
+		}
+	}
+	recorder := record.NewFakeRecorder(10)
+	r := &reconciler{
+		client:              fake.NewClientBuilder().WithObjects(deployment("web"), deployment("api")).Build(),
+		backupRegistry:      u.Host + "/backup",
+		maxConcurrentCopies: 1,
+		tagMutationPolicy:   tagMutationPreserve,
+		inventory:           newInventory(),
+		backoff:             newBackoffTracker(),
+		recorder:            recorder,
+	}
+	ctx := context.Background()
+	deployments := r.forKind(workloadKinds["Deployment"])
+
+	_, err = deployments.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: "web"}})
+	require.NoError(t, err)
+	require.Empty(t, recorder.Events)
+
+	//upstream tag is moved, the next workload using it gets the previous image
+	moved, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(srcRef, moved))
+	movedDigest, err := moved.Digest()
+	require.NoError(t, err)
+
+	_, err = deployments.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: "api"}})
+	require.NoError(t, err)
+	current := &appsv1.Deployment{}
+	require.NoError(t, r.client.Get(ctx, types.NamespacedName{Namespace: "test", Name: "api"}, current))
+	require.Equal(t, r.getTargetImage(srcRef.String()), current.Spec.Template.Spec.Containers[0].Image)
+
+	require.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	require.Contains(t, event, "BackupPreserved")
+	require.Contains(t, event, movedDigest.String())
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// workloadAdapter is a kind of workloads managed by the controller. Every kind is
+// reconciled by its own controller (see reconciler.forKind), so supporting a new kind
+// means implementing the adapter and adding it to workloadKinds
+type workloadAdapter interface {
+	// kind returns name of the kind, as used in workload references
+	kind() string
+	// newObject returns empty object of the kind
+	newObject() client.Object
+	// newList returns empty list of objects of the kind
+	newList() client.ObjectList
+	// podSpec returns pod spec of the object. It may be a copy, so images are changed with rewriteImages
+	podSpec(obj client.Object) (*v1.PodSpec, error)
+	// podTemplate returns part of the object, that changes when its owner rolls out a new version
+	podTemplate(obj client.Object) (interface{}, error)
+	// rewriteImages replaces images of the object according to the mapping
+	rewriteImages(obj client.Object, mapping map[string]string) error
+	// imagePatch returns patch, that writes images of the object along with the annotations
+	imagePatch(obj client.Object, annotations map[string]interface{}) (types.PatchType, []byte, error)
+	// selector returns selector of pods of the object
+	selector(obj client.Object) (labels.Selector, error)
+	// rolloutComplete checks if all pods of the object are updated and available
+	rolloutComplete(obj client.Object) bool
+}
+
+// workloadKinds are managed kinds by their names. Custom kinds are added with registerCustomKind
+var workloadKinds = map[string]workloadAdapter{
+	"Deployment": templateAdapter{deployments{}},
+	"DaemonSet":  templateAdapter{daemonSets{}},
+}
+
+// adapterOf returns adapter of the object kind
+func adapterOf(obj client.Object) (workloadAdapter, error) {
+	if u, isUnstructured := obj.(*unstructured.Unstructured); isUnstructured {
+		return customKindOf(u)
+	}
+	for _, adapter := range workloadKinds {
+		if reflect.TypeOf(adapter.newObject()) == reflect.TypeOf(obj) {
+			return adapter, nil
+		}
+	}
+	return nil, fmt.Errorf("object of type %T is not supported", obj)
+}
+
+// newWorkload returns empty object of the workload kind
+func newWorkload(kind string) (client.Object, error) {
+	adapter, registered := workloadKinds[kind]
+	if !registered {
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+	return adapter.newObject(), nil
+}
+
+// kindOf returns name of the workload kind, as used in workload references
+func kindOf(obj client.Object) string {
+	adapter, err := adapterOf(obj)
+	if err != nil {
+		return fmt.Sprintf("%T", obj)
+	}
+	return adapter.kind()
+}
+
+// podSpecOf returns pod spec of the workload.
+// NOTE! Pod spec of custom kinds is a copy, use rewriteWorkloadImages to change images
+func podSpecOf(obj client.Object) (*v1.PodSpec, error) {
+	adapter, err := adapterOf(obj)
+	if err != nil {
+		return nil, err
+	}
+	return adapter.podSpec(obj)
+}
+
+// podTemplateOf returns pod template of the workload (pod spec for custom kinds)
+func podTemplateOf(obj client.Object) (interface{}, error) {
+	adapter, err := adapterOf(obj)
+	if err != nil {
+		return nil, err
+	}
+	return adapter.podTemplate(obj)
+}
+
+// rewriteWorkloadImages replaces images of the workload according to the mapping
+func rewriteWorkloadImages(obj client.Object, mapping map[string]string) error {
+	adapter, err := adapterOf(obj)
+	if err != nil {
+		return err
+	}
+	return adapter.rewriteImages(obj, mapping)
+}
+
+// selectorOf returns pod selector of the workload
+func selectorOf(obj client.Object) (labels.Selector, error) {
+	adapter, err := adapterOf(obj)
+	if err != nil {
+		return nil, err
+	}
+	return adapter.selector(obj)
+}
+
+// rolloutComplete checks if all pods of the workload are updated and available.
+// Rollout of unsupported objects is considered complete
+func rolloutComplete(obj client.Object) bool {
+	adapter, err := adapterOf(obj)
+	if err != nil {
+		return true
+	}
+	return adapter.rolloutComplete(obj)
+}
+
+// templateKind is a built-in kind, that has typed pod template and selector
+type templateKind interface {
+	kind() string
+	newObject() client.Object
+	newList() client.ObjectList
+	template(obj client.Object) (*v1.PodTemplateSpec, *metav1.LabelSelector, error)
+	rolloutComplete(obj client.Object) bool
+}
+
+// templateAdapter adapts built-in kinds. Images are written with strategic merge patch,
+// which merges containers by name, so other fields of the object are left to their
+// owners (i.e. GitOps tools, HPA)
+type templateAdapter struct {
+	templateKind
+}
+
+func (a templateAdapter) podSpec(obj client.Object) (*v1.PodSpec, error) {
+	template, _, err := a.template(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &template.Spec, nil
+}
+
+func (a templateAdapter) podTemplate(obj client.Object) (interface{}, error) {
+	template, _, err := a.template(obj)
+	return template, err
+}
+
+func (a templateAdapter) rewriteImages(obj client.Object, mapping map[string]string) error {
+	podSpec, err := a.podSpec(obj)
+	if err != nil {
+		return err
+	}
+	rewriteImages(podSpec, mapping)
+	return nil
+}
+
+func (a templateAdapter) imagePatch(obj client.Object, annotations map[string]interface{}) (types.PatchType, []byte, error) {
+	podSpec, err := a.podSpec(obj)
+	if err != nil {
+		return "", nil, err
+	}
+
+	templateSpec := map[string]interface{}{"containers": containerImages(podSpec.Containers)}
+	if len(podSpec.InitContainers) != 0 {
+		templateSpec["initContainers"] = containerImages(podSpec.InitContainers)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": obj.GetResourceVersion(),
+			"annotations":     annotations,
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": templateSpec,
+			},
+		},
+	})
+	return types.StrategicMergePatchType, data, err
+}
+
+func (a templateAdapter) selector(obj client.Object) (labels.Selector, error) {
+	_, selector, err := a.template(obj)
+	if err != nil {
+		return nil, err
+	}
+	return metav1.LabelSelectorAsSelector(selector)
+}
+
+// deployments is templateKind of Deployment
+type deployments struct{}
+
+func (deployments) kind() string { return "Deployment" }
+
+func (deployments) newObject() client.Object { return &appsv1.Deployment{} }
+
+func (deployments) newList() client.ObjectList { return &appsv1.DeploymentList{} }
+
+func (deployments) template(obj client.Object) (*v1.PodTemplateSpec, *metav1.LabelSelector, error) {
+	o, isDeployment := obj.(*appsv1.Deployment)
+	if !isDeployment {
+		return nil, nil, fmt.Errorf("object of type %T is not a Deployment", obj)
+	}
+	return &o.Spec.Template, o.Spec.Selector, nil
+}
+
+func (deployments) rolloutComplete(obj client.Object) bool {
+	o, isDeployment := obj.(*appsv1.Deployment)
+	if !isDeployment {
+		return true
+	}
+	replicas := int32(1)
+	if o.Spec.Replicas != nil {
+		replicas = *o.Spec.Replicas
+	}
+	return o.Status.ObservedGeneration >= o.Generation && o.Status.UpdatedReplicas == replicas &&
+		o.Status.AvailableReplicas == replicas && o.Status.Replicas == replicas
+}
+
+// daemonSets is templateKind of DaemonSet
+type daemonSets struct{}
+
+func (daemonSets) kind() string { return "DaemonSet" }
+
+func (daemonSets) newObject() client.Object { return &appsv1.DaemonSet{} }
+
+func (daemonSets) newList() client.ObjectList { return &appsv1.DaemonSetList{} }
+
+func (daemonSets) template(obj client.Object) (*v1.PodTemplateSpec, *metav1.LabelSelector, error) {
+	o, isDaemonSet := obj.(*appsv1.DaemonSet)
+	if !isDaemonSet {
+		return nil, nil, fmt.Errorf("object of type %T is not a DaemonSet", obj)
+	}
+	return &o.Spec.Template, o.Spec.Selector, nil
+}
+
+func (daemonSets) rolloutComplete(obj client.Object) bool {
+	o, isDaemonSet := obj.(*appsv1.DaemonSet)
+	if !isDaemonSet {
+		return true
+	}
+	return o.Status.ObservedGeneration >= o.Generation &&
+		o.Status.UpdatedNumberScheduled == o.Status.DesiredNumberScheduled &&
+		o.Status.NumberAvailable == o.Status.DesiredNumberScheduled
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Test_adapterOf checks built-in kinds are resolved to their adapters, which read and rewrite pod templates
+func Test_adapterOf(t *testing.T) {
+	template := corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.19"}}}}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+
+	for kind, obj := range map[string]client.Object{
+		"Deployment": &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Selector: selector, Template: *template.DeepCopy()}},
+		"DaemonSet":  &appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{Selector: selector, Template: *template.DeepCopy()}},
+	} {
+		adapter, err := adapterOf(obj)
+		require.NoError(t, err)
+		require.Equal(t, kind, adapter.kind())
+		require.Equal(t, kind, kindOf(obj))
+
+		s, err := selectorOf(obj)
+		require.NoError(t, err)
+		require.Equal(t, "app=web", s.String())
+
+		require.NoError(t, rewriteWorkloadImages(obj, map[string]string{"nginx:1.19": "backup:nginx_1.19"}))
+		podSpec, err := podSpecOf(obj)
+		require.NoError(t, err)
+		require.Equal(t, "backup:nginx_1.19", podSpec.Containers[0].Image)
+	}
+
+	_, err := adapterOf(&corev1.Pod{})
+	require.Error(t, err)
+}